@@ -2,18 +2,29 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 	"gopkg.in/yaml.v3"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/kustomize/api/konfig"
 	"sigs.k8s.io/kustomize/api/krusty"
 	"sigs.k8s.io/kustomize/kyaml/filesys"
 )
@@ -22,13 +33,147 @@ const kustomizeDir = "kustomization"
 const policyAPIVersion = "policy.open-cluster-management.io/v1"
 const policyKind = "Policy"
 const configPolicyKind = "ConfigurationPolicy"
+const iamPolicyKind = "IamPolicy"
+const certPolicyKind = "CertificatePolicy"
+const operatorPolicyAPIVersion = "policy.open-cluster-management.io/v1beta1"
+const operatorPolicyKind = "OperatorPolicy"
 const placementRuleAPIVersion = "apps.open-cluster-management.io/v1"
 const placementRuleKind = "PlacementRule"
 const placementBindingAPIVersion = "policy.open-cluster-management.io/v1"
 const placementBindingKind = "PlacementBinding"
 const basePatchFilename = "base-patch.yaml"
+const gatekeeperTemplatesGroup = "templates.gatekeeper.sh"
+const gatekeeperConstraintsGroup = "constraints.gatekeeper.sh"
+const copiedLabelPrefix = "manifest-"
+const timestampAnnotation = "generation-timestamp"
+const disableTemplatesAnnotation = "disable-templates"
+const placementNamePlaceholder = "{{name}}"
+const generatedByLabel = "generated-by"
+const generatedByValue = "policy-generator"
+const configHashAnnotation = "config-hash"
+const stdinPath = "-"
+
+var clusterSelectorRegex = regexp.MustCompile(`^(!)?([^=!]+)(?:(!?=)(.+))?$`)
+var clusterConditionRegex = regexp.MustCompile(`^([^=]+)=(True|False|Unknown)$`)
+var dependencyRegex = regexp.MustCompile(`^([^/=]+)/([^/=]+)(?:=(.+))?$`)
+var validSeverities = []string{"low", "medium", "high", "critical"}
+var validRecordDiffs = []string{"Log", "InStatus", "None"}
+var validComplianceStates = []string{"Compliant", "NonCompliant", "Pending"}
+var legacyRemediationActions = map[string]string{"audit": "inform", "remediate": "enforce"}
+
+// The annotation keys set by the generator default to the group of the policy API version
+var defaultAnnotationPrefix = strings.SplitN(policyAPIVersion, "/", 2)[0]
+
+// These are the metadata fields set by the API server that are removed from the object
+// manifests by --sanitize-manifests
+var sanitizedMetadataFields = []string{
+	"creationTimestamp", "generation", "managedFields", "resourceVersion", "uid",
+}
+
+// These are the kinds of the well-known cluster-scoped objects that --inject-namespace doesn't set a
+// namespace on
+var clusterScopedKinds = []string{
+	"APIService",
+	"CertificateSigningRequest",
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"CSIDriver",
+	"CSINode",
+	"CustomResourceDefinition",
+	"IngressClass",
+	"MutatingWebhookConfiguration",
+	"Namespace",
+	"Node",
+	"PersistentVolume",
+	"PriorityClass",
+	"RuntimeClass",
+	"StorageClass",
+	"ValidatingWebhookConfiguration",
+	"VolumeAttachment",
+}
+
+// These are the flags left out of the config hash since they don't affect the generated objects,
+// are paths to files whose contents are hashed instead, or only affect the resolved values of
+// other flags
+var configHashExcludedFlags = []string{
+	"output", "output-dir", "output-mode", "report", "validate-cmd", "placement-only", "version",
+	"verbose", "validate", "patches", "placement", "placement-binding", "accept-legacy-actions",
+	"standard-annotations",
+}
+
+// These are set at build time with -ldflags "-X main.version=... -X main.buildDate=..."
+var version = "unknown"
+var buildDate = "unknown"
+
+// policyReport is the summary of a generated policy written by --report.
+type policyReport struct {
+	Name             string `json:"name"`
+	Namespace        string `json:"namespace"`
+	Placement        string `json:"placement"`
+	PlacementBinding string `json:"placementBinding"`
+}
 
-var clusterSelectorRegex = regexp.MustCompile(`^(.+)=(.+)$`)
+// policyOptions are the options used by createPatchFromK8sObjects to generate the policy patch.
+type policyOptions struct {
+	name               string
+	namespace          string
+	configPolicyName   string
+	remAction          string
+	severity           string
+	recordDiff         string
+	annotations        map[string]string
+	labels             map[string]string
+	disabled           bool
+	dependencies       []map[string]string
+	raw                bool
+	injectNamespace    bool
+	sanitize           bool
+	dedup              bool
+	copyPolicyMetadata *bool
+}
+
+// verboseLogger writes the logs up to the level set by --verbose to stderr so
+// that stdout is kept for the generated YAML.
+type verboseLogger struct {
+	verbosity int
+	out       io.Writer
+}
+
+// placementOptions are the options used by getPlacementObjects to generate the
+// placement rule and placement binding.
+type placementOptions struct {
+	policyNamespace   string
+	policyName        string
+	path              string
+	ruleName          string
+	bindingPath       string
+	namePattern       string
+	apiVersion        string
+	clusterSelectors  []string
+	clusterConditions []string
+	requireSelectors  bool
+}
+
+// flagOptions are the flag values validated by assertValidFlags.
+type flagOptions struct {
+	policyNamespace    string
+	policyName         string
+	configPolicyName   string
+	remAction          string
+	severity           string
+	recordDiff         string
+	outputPath         string
+	outputDir          string
+	outputMode         string
+	annotationPrefix   string
+	indent             int
+	maxPolicyBytes     int
+	dependencies       []string
+	inheritAnnotations []string
+	patches            []string
+	objDefPaths        []string
+	placement          placementOptions
+}
 
 // Create a new type for a list of Strings
 type stringList []string
@@ -73,449 +218,2136 @@ func unmarshalObjDefFile(objDefFile []byte) (*[]interface{}, error) {
 	return &yamlDocs, nil
 }
 
-func createPatchFromK8sObjects(
-	name,
-	namespace,
-	remAction,
-	severity string,
-	annotations *map[string]string,
-	disabled bool,
-	objDefFiles *[][]byte,
-) ([]byte, error) {
-	objDefYamls := []interface{}{}
-	for _, objDefFile := range *objDefFiles {
-		objDefs, err := unmarshalObjDefFile(objDefFile)
-		if err != nil {
-			return nil, err
-		}
+// getObjectIdentity returns a string that identifies the input object by its
+// kind, API group, namespace, and name in the format of "kind.group namespace/name".
+// Objects in the core API group are in the format of "kind namespace/name".
+func getObjectIdentity(obj map[string]interface{}) string {
+	kind, _, _ := unstructured.NestedString(obj, "kind")
+	apiVersion, _, _ := unstructured.NestedString(obj, "apiVersion")
+	if groupVersion := strings.SplitN(apiVersion, "/", 2); len(groupVersion) == 2 {
+		kind = kind + "." + groupVersion[0]
+	}
+	namespace, _, _ := unstructured.NestedString(obj, "metadata", "namespace")
+	name, _, _ := unstructured.NestedString(obj, "metadata", "name")
 
-		if len(*objDefs) == 0 {
-			return nil, errors.New("object manifest files cannot be empty")
+	if namespace == "" {
+		return fmt.Sprintf("%s %s", kind, name)
+	}
+
+	return fmt.Sprintf("%s %s/%s", kind, namespace, name)
+}
+
+// assertUniqueObjects returns an error if more than one of the input objects
+// has the same kind, API group, namespace, and name.
+func assertUniqueObjects(objDefs []interface{}) error {
+	identities := map[string]bool{}
+	for _, objDef := range objDefs {
+		identity := getObjectIdentity(objDef.(map[string]interface{}))
+		if identities[identity] {
+			return fmt.Errorf("the object manifests contain the %s object more than once", identity)
 		}
 
-		objDefYamls = append(objDefYamls, *objDefs...)
+		identities[identity] = true
 	}
 
-	policyTemplate := map[string]map[string]interface{}{
-		"objectDefinition": {
-			"apiVersion": policyAPIVersion,
-			"kind":       configPolicyKind,
-			"spec": map[string]interface{}{
-				"remediationAction": remAction,
-				"severity":          severity,
-				"object-templates":  objDefYamls,
-			},
-		},
-	}
+	return nil
+}
 
-	// Create a map directly instead of using the config-policy-controller Go
-	// module to avoid default values being set in the patch.
-	patch := map[string]interface{}{
-		"apiVersion": "policy.open-cluster-management.io/v1",
-		"kind":       "Policy",
-		"metadata": map[string]interface{}{
-			"name":        name,
-			"namespace":   namespace,
-			"annotations": *annotations,
-		},
-		"spec": map[string]interface{}{
-			"remediationAction": remAction,
-			"disabled":          disabled,
-			"policy-templates":  []map[string]map[string]interface{}{policyTemplate},
-		},
+// dedupObjects returns the input objects with only the first occurrence of
+// each object with the same kind, API group, namespace, and name kept.
+func dedupObjects(objDefs []interface{}) []interface{} {
+	identities := map[string]bool{}
+	uniqueObjDefs := []interface{}{}
+	for _, objDef := range objDefs {
+		identity := getObjectIdentity(objDef.(map[string]interface{}))
+		if identities[identity] {
+			continue
+		}
+
+		identities[identity] = true
+		uniqueObjDefs = append(uniqueObjDefs, objDef)
 	}
 
-	return yaml.Marshal(patch)
+	return uniqueObjDefs
 }
 
-func errorAndExit(msg string, formatArgs ...interface{}) {
-	printArgs := make([]interface{}, len(formatArgs))
-	copy(printArgs, formatArgs)
-	fmt.Fprintf(os.Stderr, msg, printArgs...)
-	fmt.Fprint(os.Stderr, "\n")
-	os.Exit(1)
+// isPolicyObject determines if the input object is a Policy.
+func isPolicyObject(obj map[string]interface{}) bool {
+	apiVersion, _, _ := unstructured.NestedString(obj, "apiVersion")
+	group := strings.SplitN(apiVersion, "/", 2)[0]
+	kind, _, _ := unstructured.NestedString(obj, "kind")
+
+	return group == strings.SplitN(policyAPIVersion, "/", 2)[0] && kind == policyKind
 }
 
-func assertValidFlags(
-	policyNamespace,
-	policyName,
-	placementPath string,
-	clusterSelectors stringList,
-	patches stringList,
-	objDefs []string,
-) {
-	if policyName == "" {
-		errorAndExit("The --name flag must be set")
+// isPolicyTemplateObject determines if the input object should be added
+// directly as a policy-template instead of being wrapped in a
+// ConfigurationPolicy. This is the case for Gatekeeper ConstraintTemplates and
+// constraints based on their apiVersion group and for IamPolicy,
+// CertificatePolicy, and OperatorPolicy objects.
+func isPolicyTemplateObject(obj map[string]interface{}) bool {
+	apiVersion, _, _ := unstructured.NestedString(obj, "apiVersion")
+	group := strings.SplitN(apiVersion, "/", 2)[0]
+	if group == gatekeeperTemplatesGroup || group == gatekeeperConstraintsGroup {
+		return true
 	}
 
-	if policyNamespace == "" {
-		errorAndExit("The --namespace flag must be set")
+	kind, _, _ := unstructured.NestedString(obj, "kind")
+	if apiVersion == operatorPolicyAPIVersion {
+		return kind == operatorPolicyKind
 	}
 
-	if placementPath != "" {
-		if _, err := os.Stat(placementPath); err != nil {
-			errorAndExit("The placement %s could not be read", placementPath)
-		}
+	if apiVersion != policyAPIVersion {
+		return false
 	}
 
-	for _, clusterSelector := range clusterSelectors {
-		if matched := clusterSelectorRegex.MatchString(clusterSelector); !matched {
-			errorAndExit(
-				`The clusterSelector "%s" must be in the format of "label=value"`,
-				clusterSelector,
+	return kind == iamPolicyKind || kind == certPolicyKind
+}
+
+// validatePolicyTemplateObject validates the fields of a policy-template object
+// that is added directly to the policy.
+func validatePolicyTemplateObject(obj map[string]interface{}) error {
+	kind, _, _ := unstructured.NestedString(obj, "kind")
+	name, _, _ := unstructured.NestedString(obj, "metadata", "name")
+
+	switch kind {
+	case iamPolicyKind:
+		maxUsers, found, _ := unstructured.NestedFieldNoCopy(
+			obj, "spec", "maxClusterRoleBindingUsers",
+		)
+		if !found {
+			return fmt.Errorf(
+				"the IamPolicy %s must have spec.maxClusterRoleBindingUsers set", name,
 			)
 		}
-	}
 
-	for _, patchPath := range patches {
-		if _, err := os.Stat(patchPath); err != nil {
-			errorAndExit("The patch %s could not be read", patchPath)
+		if maxUsersInt, ok := maxUsers.(int); !ok || maxUsersInt < 0 {
+			return fmt.Errorf(
+				"the IamPolicy %s must have spec.maxClusterRoleBindingUsers set to a "+
+					"non-negative integer",
+				name,
+			)
+		}
+	case certPolicyKind:
+		for _, field := range []string{"minimumDuration", "minimumCADuration"} {
+			duration, found, err := unstructured.NestedString(obj, "spec", field)
+			if err != nil {
+				return fmt.Errorf("the CertificatePolicy %s must have spec.%s as a string", name, field)
+			}
+
+			if !found {
+				continue
+			}
+
+			if _, err := time.ParseDuration(duration); err != nil {
+				return fmt.Errorf(
+					`the CertificatePolicy %s has an invalid spec.%s of "%s": %v`,
+					name,
+					field,
+					duration,
+					err,
+				)
+			}
+		}
+	case operatorPolicyKind:
+		for _, field := range []string{"name", "channel", "source"} {
+			value, _, _ := unstructured.NestedString(obj, "spec", "subscription", field)
+			if value == "" {
+				return fmt.Errorf(
+					"the OperatorPolicy %s must have spec.subscription.%s set", name, field,
+				)
+			}
 		}
-	}
 
-	for _, objDefPath := range objDefs {
-		if _, err := os.Stat(objDefPath); err != nil {
-			errorAndExit("The object manifest %s could not be read", objDefPath)
+		approval, found, _ := unstructured.NestedString(
+			obj, "spec", "subscription", "installPlanApproval",
+		)
+		if found && approval != "Automatic" && approval != "Manual" {
+			return fmt.Errorf(
+				`the OperatorPolicy %s has an invalid spec.subscription.installPlanApproval of `+
+					`"%s"; it must be Automatic or Manual`,
+				name,
+				approval,
+			)
 		}
 	}
 
+	return nil
 }
 
-func prepareKustomizationEnv(
-	fSys filesys.FileSystem, patches []string, policyNamespace, policyName string,
-) error {
-	kustomizationYamlFile := map[string][]interface{}{
-		"resources": {"configurationpolicy.yaml"},
-		// Seed the dynamically created patch
-		"patchesStrategicMerge": {basePatchFilename},
+// createPatchFromK8sObjects creates the policy patch YAML from the input object
+// manifest files. The objects are wrapped in a ConfigurationPolicy unless they
+// are added directly as their own policy-templates.
+func createPatchFromK8sObjects(options policyOptions, objDefFiles *[][]byte) ([]byte, error) {
+	configPolicySpec := map[string]interface{}{
+		"remediationAction": options.remAction,
+		"severity":          options.severity,
+	}
+	if options.copyPolicyMetadata != nil {
+		configPolicySpec["copyPolicyMetadata"] = *options.copyPolicyMetadata
 	}
 
-	// Get all the patches
-	for i, patchPath := range patches {
-		fileBytes, err := ioutil.ReadFile(patchPath)
-		if err != nil {
-			return fmt.Errorf("failed to read the patch %s", patchPath)
+	if options.recordDiff != "" {
+		configPolicySpec["recordDiff"] = options.recordDiff
+	}
+
+	// The ConfigurationPolicy is left out only if all the objects are added directly as their own
+	// policy-templates
+	includeConfigPolicy := true
+	objDefTemplates := []map[string]map[string]interface{}{}
+	if options.raw {
+		rawObjDefs := []string{}
+		for _, objDefFile := range *objDefFiles {
+			if len(bytes.TrimSpace(objDefFile)) == 0 {
+				return nil, errors.New("object manifest files cannot be empty")
+			}
+
+			rawObjDefs = append(rawObjDefs, strings.TrimRight(string(objDefFile), "\n"))
 		}
 
-		var patchYaml map[string]interface{}
-		err = yaml.Unmarshal(fileBytes, &patchYaml)
+		configPolicySpec["object-templates-raw"] = strings.Join(rawObjDefs, "\n") + "\n"
+	} else {
+		var configPolicyObjDefs []interface{}
+		var err error
+		configPolicyObjDefs, objDefTemplates, err = getObjectTemplates(options, objDefFiles)
 		if err != nil {
-			return fmt.Errorf("the patch %s is in an invalid format", patchPath)
+			return nil, err
 		}
 
-		// Populate some required fields that were provided and are required by Kustomize
-		unstructured.SetNestedField(patchYaml, policyName, "metadata", "name")
-		unstructured.SetNestedField(patchYaml, policyNamespace, "metadata", "namespace")
-		// Populate some fields that are required by Kustomize and always the same
-		apiVersion, found, err := unstructured.NestedString(patchYaml, "apiVersion")
-		if err != nil || (found && apiVersion != policyAPIVersion) {
-			return fmt.Errorf(
-				"patches must have apiVersion not be set or set to %s", policyAPIVersion,
-			)
-		} else if !found {
-			unstructured.SetNestedField(patchYaml, policyAPIVersion, "apiVersion")
-		}
+		configPolicySpec["object-templates"] = configPolicyObjDefs
+		includeConfigPolicy = len(configPolicyObjDefs) != 0 || len(objDefTemplates) == 0
+	}
 
-		kind, found, err := unstructured.NestedString(patchYaml, "kind")
-		if err != nil || (found && kind != policyKind) {
-			return fmt.Errorf("patches must have kind not be set or set to %s", policyKind)
-		} else if !found {
-			unstructured.SetNestedField(patchYaml, policyKind, "kind")
+	policyTemplates := []map[string]map[string]interface{}{}
+	if includeConfigPolicy {
+		policyTemplate := map[string]map[string]interface{}{
+			"objectDefinition": {
+				"apiVersion": policyAPIVersion,
+				"kind":       configPolicyKind,
+				"metadata": map[string]interface{}{
+					"name": options.configPolicyName,
+				},
+				"spec": configPolicySpec,
+			},
 		}
+		policyTemplates = append(policyTemplates, policyTemplate)
+	}
+	policyTemplates = append(policyTemplates, objDefTemplates...)
+
+	return createPolicyPatch(
+		options.name,
+		options.namespace,
+		options.remAction,
+		&options.annotations,
+		&options.labels,
+		options.disabled,
+		&options.dependencies,
+		policyTemplates,
+	)
+}
 
-		fileBytes, err = yaml.Marshal(patchYaml)
+// getObjectTemplates parses the input object manifest files and returns the
+// objects to wrap in the ConfigurationPolicy and the policy-templates of the
+// objects that are added directly to the policy.
+func getObjectTemplates(
+	options policyOptions, objDefFiles *[][]byte,
+) ([]interface{}, []map[string]map[string]interface{}, error) {
+	objDefYamls := []interface{}{}
+	for _, objDefFile := range *objDefFiles {
+		objDefs, err := unmarshalObjDefFile(objDefFile)
 		if err != nil {
-			return fmt.Errorf("the modifications on patch %s failed", patchPath)
+			return nil, nil, err
 		}
 
-		fsPath := fmt.Sprintf("userpatch%d.yaml", i+1)
-		err = fSys.WriteFile(path.Join(kustomizeDir, fsPath), fileBytes)
-		if err != nil {
-			return fmt.Errorf("failed to load the patch %s in memory", patchPath)
+		if len(*objDefs) == 0 {
+			return nil, nil, errors.New("object manifest files cannot be empty")
 		}
 
-		kustomizationYamlFile["patchesStrategicMerge"] = append(
-			kustomizationYamlFile["patchesStrategicMerge"],
-			fsPath,
-		)
-	}
+		if options.sanitize {
+			for _, objDef := range *objDefs {
+				sanitizeObject(objDef.(map[string]interface{}))
+			}
+		}
 
-	kustomizationBytes, err := yaml.Marshal(kustomizationYamlFile)
-	if err != nil {
-		return err
+		objDefYamls = append(objDefYamls, *objDefs...)
 	}
 
-	err = fSys.WriteFile(path.Join(kustomizeDir, "kustomization.yaml"), kustomizationBytes)
-	if err != nil {
-		panic(err)
+	if options.dedup {
+		objDefYamls = dedupObjects(objDefYamls)
 	}
 
-	return nil
-}
+	// Gatekeeper, IamPolicy, CertificatePolicy, and OperatorPolicy objects are not
+	// wrapped in a ConfigurationPolicy and are instead added directly as their own
+	// policy-templates
+	configPolicyObjDefs := []interface{}{}
+	objDefTemplates := []map[string]map[string]interface{}{}
+	for _, objDef := range objDefYamls {
+		if isPolicyObject(objDef.(map[string]interface{})) {
+			name, _, _ := unstructured.NestedString(
+				objDef.(map[string]interface{}), "metadata", "name",
+			)
 
-func addCommentHeader(policyYAML *[]byte) *[]byte {
-	args := []string{path.Base(os.Args[0])}
-	args = append(args, os.Args[1:]...)
-	outputYAML := []byte(
-		fmt.Sprintf(`#
-# This file is autogenerated by %s
-# To update, run:
-#
-#    %s
-#
----
-`,
-			args[0],
-			strings.Join(args, " "),
-		),
-	)
+			return nil, nil, fmt.Errorf(
+				"the object manifest %s is a Policy which can't be wrapped in another policy; "+
+					"use the objects in its policy-templates as the object manifests instead",
+				name,
+			)
+		}
 
-	outputYAML = append(outputYAML, *policyYAML...)
-	return &outputYAML
-}
+		if isPolicyTemplateObject(objDef.(map[string]interface{})) {
+			err := validatePolicyTemplateObject(objDef.(map[string]interface{}))
+			if err != nil {
+				return nil, nil, err
+			}
 
-func addPlacementObjects(
-	policyYaml *[]byte,
-	policyNamespace,
-	policyName,
-	placementPath string,
-	clusterSelectors stringList,
-) (*[]byte, error) {
+			objDefTemplates = append(
+				objDefTemplates,
+				map[string]map[string]interface{}{
+					"objectDefinition": objDef.(map[string]interface{}),
+				},
+			)
+		} else {
+			if options.injectNamespace {
+				objDefMap := objDef.(map[string]interface{})
+				kind, _, _ := unstructured.NestedString(objDefMap, "kind")
+				_, found, _ := unstructured.NestedString(objDefMap, "metadata", "namespace")
+				if !found && !containsString(clusterScopedKinds, kind) {
+					err := unstructured.SetNestedField(
+						objDefMap, options.namespace, "metadata", "namespace",
+					)
+					if err != nil {
+						return nil, nil, fmt.Errorf(
+							"failed to set the namespace on an object: %v", err,
+						)
+					}
+				}
+			}
 
-	matchExpressions := []map[string]interface{}{}
-	for _, clusterSelector := range clusterSelectors {
-		// This was validated already in the assertValidFlags function
-		matches := clusterSelectorRegex.FindStringSubmatch(clusterSelector)
-		label := matches[1]
-		value := matches[2]
-		matchExpression := map[string]interface{}{
-			"key":      label,
-			"operator": "In",
-			"values":   []string{value},
+			configPolicyObjDefs = append(configPolicyObjDefs, objDef)
 		}
-		matchExpressions = append(matchExpressions, matchExpression)
 	}
 
-	combinedYAML := *policyYaml
-	var placementRuleName string
-	if placementPath != "" {
-		placementBytes, err := ioutil.ReadFile(placementPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read %s", placementPath)
-		}
+	err := assertUniqueObjects(configPolicyObjDefs)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		objects, err := unmarshalObjDefFile(placementBytes)
-		if err != nil {
-			return nil, fmt.Errorf("the placement path %s is invalid YAML: %v", placementPath, err)
-		}
+	return configPolicyObjDefs, objDefTemplates, nil
+}
 
-		for _, object := range *objects {
-			var object = object.(map[string]interface{})
-			if kind, _, _ := unstructured.NestedString(object, "kind"); kind != placementRuleKind {
-				continue
-			}
+// createPolicyPatch creates the policy patch YAML with the input
+// policy-templates.
+func createPolicyPatch(
+	name,
+	namespace,
+	remAction string,
+	annotations *map[string]string,
+	labels *map[string]string,
+	disabled bool,
+	dependencies *[]map[string]string,
+	policyTemplates []map[string]map[string]interface{},
+) ([]byte, error) {
+	// Create a map directly instead of using the config-policy-controller Go
+	// module to avoid default values being set in the patch.
+	metadata := map[string]interface{}{
+		"name":        name,
+		"namespace":   namespace,
+		"annotations": *annotations,
+	}
+	if len(*labels) != 0 {
+		metadata["labels"] = *labels
+	}
 
-			var found bool
-			placementRuleName, found, err = unstructured.NestedString(object, "metadata", "name")
-			if !found || err != nil {
-				return nil, fmt.Errorf("the placement path %s must have a name set", placementPath)
-			}
+	spec := map[string]interface{}{
+		"remediationAction": remAction,
+		"disabled":          disabled,
+		"policy-templates":  policyTemplates,
+	}
+	if len(*dependencies) != 0 {
+		spec["dependencies"] = *dependencies
+	}
 
-			break
-		}
+	patch := map[string]interface{}{
+		"apiVersion": "policy.open-cluster-management.io/v1",
+		"kind":       "Policy",
+		"metadata":   metadata,
+		"spec":       spec,
+	}
 
-		if placementRuleName == "" {
-			return nil, fmt.Errorf(
-				"the placement path %s did not have a placement rule", placementPath,
-			)
-		}
-	} else {
-		placementRuleName = "placement-" + policyName
-		rule := map[string]interface{}{
-			"apiVersion": placementRuleAPIVersion,
-			"kind":       placementRuleKind,
-			"metadata": map[string]interface{}{
-				"name":      placementRuleName,
-				"namespace": policyNamespace,
-			},
-			"spec": map[string]interface{}{
-				"clusterConditions": []map[string]string{
-					{"status": "True", "type": "ManagedClusterConditionAvailable"},
-				},
-				"clusterSelector": map[string]interface{}{
-					"matchExpressions": matchExpressions,
-				},
-			},
-		}
+	return yaml.Marshal(patch)
+}
 
-		ruleYAML, err := yaml.Marshal(rule)
-		// An error shouldn't be possible so panic if it is encountered
-		if err != nil {
-			panic(err)
+// getKustomizationPath returns the path to the Kustomization file in the input
+// directory. If there isn't one, an empty string is returned.
+func getKustomizationPath(dir string) string {
+	for _, filename := range konfig.RecognizedKustomizationFileNames() {
+		kustomizationPath := path.Join(dir, filename)
+		if _, err := os.Stat(kustomizationPath); err == nil {
+			return kustomizationPath
 		}
-		ruleYAML = append([]byte("---\n"), ruleYAML...)
-		combinedYAML = append(combinedYAML, ruleYAML...)
 	}
 
-	binding := map[string]interface{}{
-		"apiVersion": placementBindingAPIVersion,
-		"kind":       placementBindingKind,
-		"metadata": map[string]interface{}{
-			"name":      "binding-" + policyName,
-			"namespace": policyNamespace,
-		},
-		"placementRef": map[string]string{
-			"name":     placementRuleName,
-			"kind":     placementRuleKind,
-			"apiGroup": placementRuleAPIVersion,
-		},
-		"subjects": []map[string]string{
-			{
-				"name":     policyName,
-				"kind":     policyKind,
-				"apiGroup": policyAPIVersion,
-			},
-		},
-	}
+	return ""
+}
 
-	bindingYAML, err := yaml.Marshal(binding)
-	// An error shouldn't be possible so panic if it is encountered
+// runKustomizeBuild runs the equivalent of kustomize build on the input
+// directory and returns the rendered YAML.
+func runKustomizeBuild(dir string) ([]byte, error) {
+	k := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+	m, err := k.Run(filesys.MakeFsOnDisk(), dir)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	bindingYAML = append([]byte("---\n"), bindingYAML...)
-	combinedYAML = append(combinedYAML, bindingYAML...)
 
-	return &combinedYAML, nil
+	return m.AsYaml()
 }
 
-func main() {
-	nsFlag := pflag.StringP("namespace", "n", "", "the namespace for the policy")
-	nameFlag := pflag.String("name", "", "the name for the policy")
-	clusterSelectors := pflag.StringSlice(
-		"cluster-selectors", []string{},
-		"a comma-separated list of placement rule cluster selectors; if not provided, the "+
-			"placement rule will be for all clusters; does not take effect if --placement is set",
-	)
-	outputFlag := pflag.StringP(
-		"output", "o", "", "the path to write the policy to; defaults to stdout",
-	)
-	placementFlag := pflag.String(
-		"placement", "",
-		"the path to the placement rule to use; takes precedence over --cluster-selectors",
+// isGlob determines if the input path contains any glob pattern characters.
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// expandObjDefPaths expands any glob patterns in the input object manifest
+// paths. The paths without glob patterns are returned as is.
+func expandObjDefPaths(objDefPaths []string) ([]string, error) {
+	expandedPaths := []string{}
+	for _, objDefPath := range objDefPaths {
+		if !isGlob(objDefPath) {
+			expandedPaths = append(expandedPaths, objDefPath)
+			continue
+		}
+
+		matches, err := filepath.Glob(objDefPath)
+		if err != nil {
+			return nil, fmt.Errorf("the object manifest glob %s is invalid: %v", objDefPath, err)
+		}
+
+		expandedPaths = append(expandedPaths, matches...)
+	}
+
+	return expandedPaths, nil
+}
+
+// getCopiedManifestLabels returns the labels of the first object in the first
+// object manifest file so that they can be copied onto the policy. If a label
+// is also set by one of the patches, the copied label is prefixed with
+// "manifest-" so that both are preserved.
+func getCopiedManifestLabels(objDefFiles *[][]byte, patches []string) (map[string]string, error) {
+	copiedLabels := map[string]string{}
+	if len(*objDefFiles) == 0 {
+		return copiedLabels, nil
+	}
+
+	objDefs, err := unmarshalObjDefFile((*objDefFiles)[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(*objDefs) == 0 {
+		return copiedLabels, nil
+	}
+
+	labels, _, err := unstructured.NestedStringMap(
+		(*objDefs)[0].(map[string]interface{}), "metadata", "labels",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("the labels of the first object manifest are invalid: %v", err)
+	}
+
+	patchLabels := map[string]string{}
+	for _, patchPath := range patches {
+		fileBytes, err := ioutil.ReadFile(patchPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the patch %s", patchPath)
+		}
+
+		var patchYaml map[string]interface{}
+		err = yaml.Unmarshal(fileBytes, &patchYaml)
+		if err != nil {
+			return nil, fmt.Errorf("the patch %s is in an invalid format", patchPath)
+		}
+
+		labels, _, _ := unstructured.NestedStringMap(patchYaml, "metadata", "labels")
+		for key, value := range labels {
+			patchLabels[key] = value
+		}
+	}
+
+	for key, value := range labels {
+		if _, found := patchLabels[key]; found {
+			key = copiedLabelPrefix + key
+		}
+
+		copiedLabels[key] = value
+	}
+
+	return copiedLabels, nil
+}
+
+// sanitizeObject removes the status and the metadata fields set by the API
+// server from the input object so that manifests exported from a cluster can be
+// used as is.
+func sanitizeObject(object map[string]interface{}) {
+	unstructured.RemoveNestedField(object, "status")
+	for _, field := range sanitizedMetadataFields {
+		unstructured.RemoveNestedField(object, "metadata", field)
+	}
+}
+
+// getConfigHash returns a stable SHA-256 hash of the flags that affect the
+// generated objects and the contents of the input files so that generated
+// objects can be traced back to the configuration that generated them. The
+// flags are hashed in the sorted order of their names followed by the object
+// manifests, patches, placement, and placement binding in that order. The
+// values in resolvedFlags are hashed instead of the values of the flags with
+// the same names so that the flags that are defaulted or normalized result in
+// the same hash as their resolved values.
+func getConfigHash(
+	flags *pflag.FlagSet,
+	resolvedFlags map[string]string,
+	objDefFiles *[][]byte,
+	patches []string,
+	placementPath,
+	placementBindingPath string,
+) (string, error) {
+	hash := sha256.New()
+	writeField := func(name string, value []byte) {
+		// Prefix the value with its length so that the boundaries between values are unambiguous
+		fmt.Fprintf(hash, "%s %d\n", name, len(value))
+		hash.Write(value)
+	}
+
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if containsString(configHashExcludedFlags, flag.Name) {
+			return
+		}
+
+		value, resolved := resolvedFlags[flag.Name]
+		if !resolved {
+			value = flag.Value.String()
+		}
+
+		writeField("flag "+flag.Name, []byte(value))
+	})
+
+	for _, objDefFile := range *objDefFiles {
+		writeField("manifest", objDefFile)
+	}
+
+	inputFiles := [][2]string{}
+	for _, patchPath := range patches {
+		inputFiles = append(inputFiles, [2]string{"patch", patchPath})
+	}
+
+	if placementPath != "" {
+		inputFiles = append(inputFiles, [2]string{"placement", placementPath})
+	}
+
+	if placementBindingPath != "" {
+		inputFiles = append(inputFiles, [2]string{"placement-binding", placementBindingPath})
+	}
+
+	for _, inputFile := range inputFiles {
+		fileBytes, err := ioutil.ReadFile(inputFile[1])
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s", inputFile[1])
+		}
+
+		writeField(inputFile[0], fileBytes)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// addManagedMetadata sets the generated-by label and the config hash
+// annotation with the input annotation prefix on the input generated objects.
+func addManagedMetadata(objects []interface{}, annotationPrefix, configHash string) {
+	for _, object := range objects {
+		object, ok := object.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		err := unstructured.SetNestedField(
+			object, generatedByValue, "metadata", "labels", generatedByLabel,
+		)
+		// An error shouldn't be possible so panic if it is encountered
+		if err != nil {
+			panic(err)
+		}
+
+		err = unstructured.SetNestedField(
+			object,
+			configHash,
+			"metadata",
+			"annotations",
+			annotationPrefix+"/"+configHashAnnotation,
+		)
+		// An error shouldn't be possible so panic if it is encountered
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// getInheritedAnnotations returns the annotations with the input keys that are
+// set on the first object in the first object manifest file so that they can be
+// copied onto the policy.
+func getInheritedAnnotations(objDefFiles *[][]byte, keys []string) (map[string]string, error) {
+	inheritedAnnotations := map[string]string{}
+	if len(keys) == 0 || len(*objDefFiles) == 0 {
+		return inheritedAnnotations, nil
+	}
+
+	objDefs, err := unmarshalObjDefFile((*objDefFiles)[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(*objDefs) == 0 {
+		return inheritedAnnotations, nil
+	}
+
+	annotations, _, err := unstructured.NestedStringMap(
+		(*objDefs)[0].(map[string]interface{}), "metadata", "annotations",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("the annotations of the first object manifest are invalid: %v", err)
+	}
+
+	for _, key := range keys {
+		if value, found := annotations[key]; found {
+			inheritedAnnotations[key] = value
+		}
+	}
+
+	return inheritedAnnotations, nil
+}
+
+// runValidateCommand runs the input command with sh -c and the input generated
+// YAML on stdin. An error with the command's stderr is returned if the command
+// fails.
+func runValidateCommand(command string, generatedYAML []byte) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(generatedYAML)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		output := strings.TrimSpace(stderr.String())
+		if output == "" {
+			return fmt.Errorf("the validation command failed: %v", err)
+		}
+
+		return fmt.Errorf("the validation command failed: %v: %s", err, output)
+	}
+
+	return nil
+}
+
+// getGenerationTimestamp returns the RFC 3339 timestamp to use for the
+// generation timestamp annotation. The timestamp is never based on the current
+// time so that the output stays deterministic. It comes from the --timestamp
+// flag if set and otherwise from the SOURCE_DATE_EPOCH environment variable.
+func getGenerationTimestamp(timestamp string) (string, error) {
+	if timestamp != "" {
+		parsed, err := time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			return "", fmt.Errorf("the timestamp %s must be in the RFC 3339 format", timestamp)
+		}
+
+		return parsed.UTC().Format(time.RFC3339), nil
+	}
+
+	sourceDateEpoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if sourceDateEpoch == "" {
+		return "", errors.New(
+			"the --timestamp flag or the SOURCE_DATE_EPOCH environment variable must be set",
+		)
+	}
+
+	epoch, err := strconv.ParseInt(sourceDateEpoch, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf(
+			"the SOURCE_DATE_EPOCH environment variable %s must be a Unix timestamp",
+			sourceDateEpoch,
+		)
+	}
+
+	return time.Unix(epoch, 0).UTC().Format(time.RFC3339), nil
+}
+
+// getDependencies converts the dependency flag values in the format of
+// "namespace/name[=complianceState]" to policy dependencies. The compliance
+// state defaults to Compliant.
+func getDependencies(dependencyFlags stringList) []map[string]string {
+	dependencies := []map[string]string{}
+	for _, dependencyFlag := range dependencyFlags {
+		// This was validated already in the assertValidFlags function
+		matches := dependencyRegex.FindStringSubmatch(dependencyFlag)
+		compliance := matches[3]
+		if compliance == "" {
+			compliance = "Compliant"
+		}
+
+		dependencies = append(dependencies, map[string]string{
+			"apiVersion": policyAPIVersion,
+			"kind":       policyKind,
+			"name":       matches[2],
+			"namespace":  matches[1],
+			"compliance": compliance,
+		})
+	}
+
+	return dependencies
+}
+
+// parseFileMode parses the input octal string such as "0644" to a file mode.
+// Only permission bits are allowed.
+func parseFileMode(mode string) (os.FileMode, error) {
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed > uint64(os.ModePerm) {
+		return 0, fmt.Errorf(`the output mode "%s" must be an octal file mode such as 0644`, mode)
+	}
+
+	return os.FileMode(parsed), nil
+}
+
+// writeReport writes a JSON report of the generated policies to the input
+// path.
+func writeReport(reportPath string, policies []policyReport) error {
+	reportBytes, err := json.MarshalIndent(map[string][]policyReport{"policies": policies}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to create the report: %v", err)
+	}
+
+	err = os.WriteFile(reportPath, append(reportBytes, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write the report to %s: %v", reportPath, err)
+	}
+
+	return nil
+}
+
+// normalizeLegacyRemediationAction converts the legacy remediation actions of
+// audit and remediate to inform and enforce. Other values are returned as is.
+func normalizeLegacyRemediationAction(remAction string) string {
+	if normalized, found := legacyRemediationActions[strings.ToLower(remAction)]; found {
+		return normalized
+	}
+
+	return remAction
+}
+
+// containsString determines if the input slice contains the input value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// capitalizeError returns the error message with the first letter capitalized
+// so that it can be displayed to the user.
+func capitalizeError(err error) string {
+	// Indexing is safe here since the error message is always ASCII
+	return strings.ToUpper(string(err.Error()[0])) + string(err.Error()[1:])
+}
+
+// log writes the input message to the logger output if the --verbose level is
+// at least the input level.
+func (l verboseLogger) log(level int, msg string, formatArgs ...interface{}) {
+	if l.verbosity < level {
+		return
+	}
+
+	fmt.Fprintf(l.out, msg, formatArgs...)
+	fmt.Fprint(l.out, "\n")
+}
+
+func errorAndExit(msg string, formatArgs ...interface{}) {
+	printArgs := make([]interface{}, len(formatArgs))
+	copy(printArgs, formatArgs)
+	fmt.Fprintf(os.Stderr, msg, printArgs...)
+	fmt.Fprint(os.Stderr, "\n")
+	os.Exit(1)
+}
+
+// assertValidObjDefPath returns an error if the input object manifest path
+// can't be read or is a directory without a Kustomization file.
+func assertValidObjDefPath(objDefPath string) error {
+	info, err := os.Stat(objDefPath)
+	if err != nil {
+		return fmt.Errorf("the object manifest %s could not be read", objDefPath)
+	}
+
+	if info.IsDir() && getKustomizationPath(objDefPath) == "" {
+		return fmt.Errorf(
+			"the object manifest directory %s must have a kustomization.yaml file", objDefPath,
+		)
+	}
+
+	return nil
+}
+
+// assertValidFlags returns an error if any of the input flag values are invalid.
+func assertValidFlags(options flagOptions) error {
+	placement := options.placement
+
+	if options.policyName == "" {
+		return errors.New("the --name flag must be set")
+	}
+
+	if options.policyNamespace == "" {
+		return errors.New("the --namespace flag must be set")
+	}
+
+	if !strings.Contains(placement.namePattern, placementNamePlaceholder) {
+		return fmt.Errorf(
+			`the placement name pattern "%s" must contain %s`,
+			placement.namePattern,
+			placementNamePlaceholder,
+		)
+	}
+
+	groupVersion := strings.Split(placement.apiVersion, "/")
+	if len(groupVersion) != 2 ||
+		len(validation.IsDNS1123Subdomain(groupVersion[0])) != 0 ||
+		len(validation.IsDNS1123Label(groupVersion[1])) != 0 {
+		return fmt.Errorf(
+			`the placement API version "%s" must be in the format of "group/version"`,
+			placement.apiVersion,
+		)
+	}
+
+	generatedNames := []string{options.policyName, options.configPolicyName}
+	if placement.bindingPath == "" {
+		generatedNames = append(generatedNames, "binding-"+options.policyName)
+	}
+
+	if placement.path == "" {
+		generatedNames = append(
+			generatedNames, getPlacementRuleName(placement.namePattern, options.policyName),
+		)
+	}
+
+	for _, name := range generatedNames {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) != 0 {
+			return fmt.Errorf(
+				`the generated name "%s" is not a valid Kubernetes name: %s`,
+				name,
+				strings.Join(errs, "; "),
+			)
+		}
+	}
+
+	if options.outputPath != "" && options.outputDir != "" {
+		return errors.New("the --output and --output-dir flags cannot both be set")
+	}
+
+	if _, err := parseFileMode(options.outputMode); err != nil {
+		return err
+	}
+
+	if options.maxPolicyBytes < 0 {
+		return errors.New("the --max-policy-bytes flag must not be negative")
+	}
+
+	// The YAML encoder only supports indentation between 2 and 9 spaces
+	if options.indent < 2 || options.indent > 9 {
+		return errors.New("the --indent flag must be between 2 and 9")
+	}
+
+	remAction := strings.ToLower(options.remAction)
+	if remAction != "inform" && remAction != "enforce" {
+		return fmt.Errorf(
+			`the remediation action "%s" of the policy %s must be inform or enforce`,
+			options.remAction,
+			options.policyName,
+		)
+	}
+
+	if !containsString(validSeverities, options.severity) {
+		return fmt.Errorf(
+			`the severity "%s" of the policy %s must be one of: %s`,
+			options.severity,
+			options.policyName,
+			strings.Join(validSeverities, ", "),
+		)
+	}
+
+	if options.recordDiff != "" && !containsString(validRecordDiffs, options.recordDiff) {
+		return fmt.Errorf(
+			`the record diff "%s" must be one of: %s`,
+			options.recordDiff,
+			strings.Join(validRecordDiffs, ", "),
+		)
+	}
+
+	placementRuleName := getPlacementRuleName(placement.namePattern, options.policyName)
+	if placement.path != "" {
+		if _, err := os.Stat(placement.path); err != nil {
+			return fmt.Errorf("the placement %s could not be read", placement.path)
+		}
+
+		var err error
+		placementRuleName, err = getPlacementFileRuleName(placement.path, placement.ruleName)
+		if err != nil {
+			return err
+		}
+	} else {
+		if placement.ruleName != "" {
+			return errors.New(
+				"the --placement-rule-name flag can only be set with the --placement flag",
+			)
+		}
+
+		if placement.requireSelectors && len(placement.clusterSelectors) == 0 {
+			return errors.New(
+				"the --cluster-selectors or --placement flag must be set when --require-selectors " +
+					"is set so that the policy doesn't target all clusters",
+			)
+		}
+	}
+
+	if placement.bindingPath != "" {
+		if _, err := os.Stat(placement.bindingPath); err != nil {
+			return fmt.Errorf("the placement binding %s could not be read", placement.bindingPath)
+		}
+
+		_, err := validatePlacementBinding(
+			placement.bindingPath, options.policyNamespace, options.policyName, placementRuleName,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, clusterSelector := range placement.clusterSelectors {
+		label, _, value, ok := parseClusterSelector(clusterSelector)
+		if !ok {
+			return fmt.Errorf(
+				`the clusterSelector "%s" must be in the format of "label=value", `+
+					`"label!=value", "label", or "!label"`,
+				clusterSelector,
+			)
+		}
+
+		if errs := validation.IsQualifiedName(label); len(errs) != 0 {
+			return fmt.Errorf(
+				`the clusterSelector "%s" has an invalid label: %s`,
+				clusterSelector,
+				strings.Join(errs, "; "),
+			)
+		}
+
+		if errs := validation.IsValidLabelValue(value); len(errs) != 0 {
+			return fmt.Errorf(
+				`the clusterSelector "%s" has an invalid value: %s`,
+				clusterSelector,
+				strings.Join(errs, "; "),
+			)
+		}
+	}
+
+	for _, clusterCondition := range placement.clusterConditions {
+		if matched := clusterConditionRegex.MatchString(clusterCondition); !matched {
+			return fmt.Errorf(
+				`the cluster condition "%s" must be in the format of "type=status" where the `+
+					`status is True, False, or Unknown`,
+				clusterCondition,
+			)
+		}
+	}
+
+	for _, dependency := range options.dependencies {
+		matches := dependencyRegex.FindStringSubmatch(dependency)
+		if matches == nil {
+			return fmt.Errorf(
+				`the dependency "%s" must be in the format of "namespace/name[=complianceState]"`,
+				dependency,
+			)
+		}
+
+		for _, name := range []string{matches[1], matches[2]} {
+			if errs := validation.IsDNS1123Subdomain(name); len(errs) != 0 {
+				return fmt.Errorf(
+					`the dependency "%s" has an invalid name or namespace "%s": %s`,
+					dependency,
+					name,
+					strings.Join(errs, "; "),
+				)
+			}
+		}
+
+		if matches[1] == options.policyNamespace && matches[2] == options.policyName {
+			return fmt.Errorf("the policy %s cannot depend on itself", options.policyName)
+		}
+
+		if matches[3] != "" {
+			if !containsString(validComplianceStates, matches[3]) {
+				return fmt.Errorf(
+					`the compliance state "%s" of the dependency "%s" must be one of: %s`,
+					matches[3],
+					dependency,
+					strings.Join(validComplianceStates, ", "),
+				)
+			}
+		}
+	}
+
+	if errs := validation.IsDNS1123Subdomain(options.annotationPrefix); len(errs) != 0 {
+		return fmt.Errorf(
+			`the annotation prefix "%s" is invalid: %s`,
+			options.annotationPrefix,
+			strings.Join(errs, "; "),
+		)
+	}
+
+	for _, annotation := range options.inheritAnnotations {
+		if errs := validation.IsQualifiedName(annotation); len(errs) != 0 {
+			return fmt.Errorf(
+				`the annotation "%s" to inherit is not a valid annotation key: %s`,
+				annotation,
+				strings.Join(errs, "; "),
+			)
+		}
+	}
+
+	for _, patchPath := range options.patches {
+		if _, err := os.Stat(patchPath); err != nil {
+			return fmt.Errorf("the patch %s could not be read", patchPath)
+		}
+	}
+
+	stdinCount := 0
+	for _, objDefPath := range options.objDefPaths {
+		if objDefPath == stdinPath {
+			stdinCount++
+			if stdinCount > 1 {
+				return errors.New("the object manifest path - for stdin can only be set once")
+			}
+
+			continue
+		}
+
+		if !isGlob(objDefPath) {
+			err := assertValidObjDefPath(objDefPath)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		matches, err := filepath.Glob(objDefPath)
+		if err != nil {
+			return fmt.Errorf("the object manifest glob %s is invalid: %v", objDefPath, err)
+		}
+
+		if len(matches) == 0 {
+			return fmt.Errorf("the object manifest glob %s did not match any files", objDefPath)
+		}
+
+		for _, match := range matches {
+			err := assertValidObjDefPath(match)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func prepareKustomizationEnv(
+	fSys filesys.FileSystem, patches []string, policyNamespace, policyName string,
+) error {
+	kustomizationYamlFile := map[string][]interface{}{
+		"resources": {"configurationpolicy.yaml"},
+		// Seed the dynamically created patch
+		"patchesStrategicMerge": {basePatchFilename},
+	}
+
+	// Get all the patches
+	for i, patchPath := range patches {
+		fileBytes, err := ioutil.ReadFile(patchPath)
+		if err != nil {
+			return fmt.Errorf("failed to read the patch %s", patchPath)
+		}
+
+		var patchYaml map[string]interface{}
+		err = yaml.Unmarshal(fileBytes, &patchYaml)
+		if err != nil {
+			return fmt.Errorf("the patch %s is in an invalid format", patchPath)
+		}
+
+		// Populate some required fields that were provided and are required by Kustomize
+		unstructured.SetNestedField(patchYaml, policyName, "metadata", "name")
+		unstructured.SetNestedField(patchYaml, policyNamespace, "metadata", "namespace")
+		// Populate some fields that are required by Kustomize and always the same
+		apiVersion, found, err := unstructured.NestedString(patchYaml, "apiVersion")
+		if err != nil || (found && apiVersion != policyAPIVersion) {
+			return fmt.Errorf(
+				"patches must have apiVersion not be set or set to %s", policyAPIVersion,
+			)
+		} else if !found {
+			unstructured.SetNestedField(patchYaml, policyAPIVersion, "apiVersion")
+		}
+
+		kind, found, err := unstructured.NestedString(patchYaml, "kind")
+		if err != nil || (found && kind != policyKind) {
+			return fmt.Errorf("patches must have kind not be set or set to %s", policyKind)
+		} else if !found {
+			unstructured.SetNestedField(patchYaml, policyKind, "kind")
+		}
+
+		fileBytes, err = yaml.Marshal(patchYaml)
+		if err != nil {
+			return fmt.Errorf("the modifications on patch %s failed", patchPath)
+		}
+
+		fsPath := fmt.Sprintf("userpatch%d.yaml", i+1)
+		err = fSys.WriteFile(path.Join(kustomizeDir, fsPath), fileBytes)
+		if err != nil {
+			return fmt.Errorf("failed to load the patch %s in memory", patchPath)
+		}
+
+		kustomizationYamlFile["patchesStrategicMerge"] = append(
+			kustomizationYamlFile["patchesStrategicMerge"],
+			fsPath,
+		)
+	}
+
+	kustomizationBytes, err := yaml.Marshal(kustomizationYamlFile)
+	if err != nil {
+		return err
+	}
+
+	err = fSys.WriteFile(path.Join(kustomizeDir, "kustomization.yaml"), kustomizationBytes)
+	if err != nil {
+		panic(err)
+	}
+
+	return nil
+}
+
+// decodeYAMLDocuments decodes the input YAML documents into YAML nodes so that
+// they can be re-encoded with their key order and styles kept.
+func decodeYAMLDocuments(yamlBytes []byte) ([]interface{}, error) {
+	documents := []interface{}{}
+	decoder := yaml.NewDecoder(bytes.NewReader(yamlBytes))
+	for {
+		var node yaml.Node
+		err := decoder.Decode(&node)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, err
+		}
+
+		documents = append(documents, &node)
+	}
+
+	return documents, nil
+}
+
+// encodeYAMLDocuments encodes the input objects as YAML documents using the
+// input number of spaces for indentation. A single encoder is used so that
+// exactly one document separator is written between each document.
+func encodeYAMLDocuments(documents []interface{}, indent int) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(indent)
+
+	for _, document := range documents {
+		err := encoder.Encode(document)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func addCommentHeader(policyYAML *[]byte, commandArgs []string, headerSeparator bool) *[]byte {
+	args := []string{path.Base(commandArgs[0])}
+	args = append(args, commandArgs[1:]...)
+	outputYAML := []byte(
+		fmt.Sprintf(`#
+# This file is autogenerated by %s
+# To update, run:
+#
+#    %s
+#
+`,
+			args[0],
+			strings.Join(args, " "),
+		),
+	)
+
+	if headerSeparator {
+		outputYAML = append(outputYAML, []byte("---\n")...)
+	}
+
+	outputYAML = append(outputYAML, *policyYAML...)
+	return &outputYAML
+}
+
+// parseClusterSelector parses the input cluster selector into its label,
+// match expression operator, and value. The supported formats are
+// "label=value" (In), "label!=value" (NotIn), "label" (Exists), and "!label"
+// (DoesNotExist). If the cluster selector is not in one of these formats, ok
+// is false.
+func parseClusterSelector(clusterSelector string) (label, operator, value string, ok bool) {
+	matches := clusterSelectorRegex.FindStringSubmatch(clusterSelector)
+	if matches == nil {
+		return "", "", "", false
+	}
+
+	label = matches[2]
+	value = matches[4]
+
+	if matches[1] == "!" {
+		if matches[3] != "" {
+			return "", "", "", false
+		}
+
+		return label, "DoesNotExist", "", true
+	}
+
+	switch matches[3] {
+	case "=":
+		operator = "In"
+	case "!=":
+		operator = "NotIn"
+	default:
+		operator = "Exists"
+	}
+
+	return label, operator, value, true
+}
+
+// getPlacementRuleName returns the generated placement rule name by replacing
+// the name placeholder in the pattern with the policy name.
+func getPlacementRuleName(pattern, policyName string) string {
+	return strings.ReplaceAll(pattern, placementNamePlaceholder, policyName)
+}
+
+// getPlacementFileRuleName returns the name of the placement rule in the input
+// placement file. If ruleName is set, the placement rule with that name is
+// selected from the file. Otherwise, the first placement rule is used. An error
+// is returned if the file can't be parsed or doesn't contain a matching named
+// placement rule.
+func getPlacementFileRuleName(placementPath, ruleName string) (string, error) {
+	placementBytes, err := ioutil.ReadFile(placementPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s", placementPath)
+	}
+
+	objects, err := unmarshalObjDefFile(placementBytes)
+	if err != nil {
+		return "", fmt.Errorf("the placement path %s is invalid YAML: %v", placementPath, err)
+	}
+
+	for _, object := range *objects {
+		var object = object.(map[string]interface{})
+		if kind, _, _ := unstructured.NestedString(object, "kind"); kind != placementRuleKind {
+			continue
+		}
+
+		name, found, err := unstructured.NestedString(object, "metadata", "name")
+		if !found || err != nil || name == "" {
+			return "", fmt.Errorf("the placement path %s must have a name set", placementPath)
+		}
+
+		if ruleName != "" && name != ruleName {
+			continue
+		}
+
+		return name, nil
+	}
+
+	if ruleName != "" {
+		return "", fmt.Errorf(
+			"the placement path %s did not have the placement rule %s", placementPath, ruleName,
+		)
+	}
+
+	return "", fmt.Errorf("the placement path %s did not have a placement rule", placementPath)
+}
+
+// validatePlacementBinding verifies that the placement binding in the input
+// file is in the policy namespace, references the placement rule, and has the
+// policy as a subject. The name of the placement binding is returned.
+func validatePlacementBinding(
+	placementBindingPath, policyNamespace, policyName, placementRuleName string,
+) (string, error) {
+	bindingBytes, err := ioutil.ReadFile(placementBindingPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s", placementBindingPath)
+	}
+
+	objects, err := unmarshalObjDefFile(bindingBytes)
+	if err != nil {
+		return "", fmt.Errorf(
+			"the placement binding path %s is invalid YAML: %v", placementBindingPath, err,
+		)
+	}
+
+	for _, object := range *objects {
+		var object = object.(map[string]interface{})
+		if kind, _, _ := unstructured.NestedString(object, "kind"); kind != placementBindingKind {
+			continue
+		}
+
+		name, _, _ := unstructured.NestedString(object, "metadata", "name")
+		namespace, _, _ := unstructured.NestedString(object, "metadata", "namespace")
+		if namespace != policyNamespace {
+			return "", fmt.Errorf(
+				"the placement binding %s must be in the policy namespace %s", name, policyNamespace,
+			)
+		}
+
+		refName, _, _ := unstructured.NestedString(object, "placementRef", "name")
+		refKind, _, _ := unstructured.NestedString(object, "placementRef", "kind")
+		if refName != placementRuleName || refKind != placementRuleKind {
+			return "", fmt.Errorf(
+				"the placement binding %s must reference the placement rule %s",
+				name,
+				placementRuleName,
+			)
+		}
+
+		subjects, _, _ := unstructured.NestedSlice(object, "subjects")
+		for _, subject := range subjects {
+			subject, ok := subject.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			subjectName, _, _ := unstructured.NestedString(subject, "name")
+			subjectKind, _, _ := unstructured.NestedString(subject, "kind")
+			if subjectName == policyName && subjectKind == policyKind {
+				return name, nil
+			}
+		}
+
+		return "", fmt.Errorf(
+			"the placement binding %s must have the policy %s as a subject", name, policyName,
+		)
+	}
+
+	return "", fmt.Errorf(
+		"the placement binding path %s did not have a placement binding", placementBindingPath,
+	)
+}
+
+// getPlacementObjects returns the placement rule and placement binding objects
+// to output with the policy. If the placement rule or placement binding is
+// provided by the user, it is not returned. The placement rule name and
+// placement binding name are also returned.
+func getPlacementObjects(options placementOptions) ([]interface{}, string, string, error) {
+	// Group the values by label and operator so that a label provided multiple
+	// times with the same operator results in a single match expression with
+	// multiple values
+	type labelOperator struct {
+		label    string
+		operator string
+	}
+	labelOperatorValues := map[labelOperator][]string{}
+	for _, clusterSelector := range options.clusterSelectors {
+		// This was validated already in the assertValidFlags function
+		label, operator, value, _ := parseClusterSelector(clusterSelector)
+		key := labelOperator{label, operator}
+		if _, found := labelOperatorValues[key]; !found {
+			labelOperatorValues[key] = []string{}
+		}
+
+		if value != "" {
+			labelOperatorValues[key] = append(labelOperatorValues[key], value)
+		}
+	}
+
+	keys := make([]labelOperator, 0, len(labelOperatorValues))
+	for key := range labelOperatorValues {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].label != keys[j].label {
+			return keys[i].label < keys[j].label
+		}
+
+		return keys[i].operator < keys[j].operator
+	})
+
+	matchExpressions := []map[string]interface{}{}
+	for _, key := range keys {
+		matchExpression := map[string]interface{}{
+			"key":      key.label,
+			"operator": key.operator,
+		}
+		if len(labelOperatorValues[key]) != 0 {
+			matchExpression["values"] = labelOperatorValues[key]
+		}
+		matchExpressions = append(matchExpressions, matchExpression)
+	}
+
+	conditions := []map[string]string{}
+	for _, clusterCondition := range options.clusterConditions {
+		// This was validated already in the assertValidFlags function
+		matches := clusterConditionRegex.FindStringSubmatch(clusterCondition)
+		conditions = append(conditions, map[string]string{
+			"status": matches[2],
+			"type":   matches[1],
+		})
+	}
+
+	placementObjects := []interface{}{}
+	var placementRuleName string
+	if options.path != "" {
+		var err error
+		placementRuleName, err = getPlacementFileRuleName(options.path, options.ruleName)
+		if err != nil {
+			return nil, "", "", err
+		}
+	} else {
+		placementRuleName = getPlacementRuleName(options.namePattern, options.policyName)
+		rule := map[string]interface{}{
+			"apiVersion": options.apiVersion,
+			"kind":       placementRuleKind,
+			"metadata": map[string]interface{}{
+				"name":      placementRuleName,
+				"namespace": options.policyNamespace,
+			},
+			"spec": map[string]interface{}{
+				"clusterConditions": conditions,
+				"clusterSelector": map[string]interface{}{
+					"matchExpressions": matchExpressions,
+				},
+			},
+		}
+
+		placementObjects = append(placementObjects, rule)
+	}
+
+	if options.bindingPath != "" {
+		bindingName, err := validatePlacementBinding(
+			options.bindingPath, options.policyNamespace, options.policyName, placementRuleName,
+		)
+		if err != nil {
+			return nil, "", "", err
+		}
+
+		return placementObjects, placementRuleName, bindingName, nil
+	}
+
+	bindingName := "binding-" + options.policyName
+	// The apiGroup fields of the placement binding only take the group without the version
+	placementAPIGroup := strings.SplitN(options.apiVersion, "/", 2)[0]
+	policyAPIGroup := strings.SplitN(policyAPIVersion, "/", 2)[0]
+	binding := map[string]interface{}{
+		"apiVersion": placementBindingAPIVersion,
+		"kind":       placementBindingKind,
+		"metadata": map[string]interface{}{
+			"name":      bindingName,
+			"namespace": options.policyNamespace,
+		},
+		"placementRef": map[string]string{
+			"name":     placementRuleName,
+			"kind":     placementRuleKind,
+			"apiGroup": placementAPIGroup,
+		},
+		"subjects": []map[string]string{
+			{
+				"name":     options.policyName,
+				"kind":     policyKind,
+				"apiGroup": policyAPIGroup,
+			},
+		},
+	}
+
+	placementObjects = append(placementObjects, binding)
+
+	return placementObjects, placementRuleName, bindingName, nil
+}
+
+// run parses the input command line arguments, which include the program name,
+// and generates the policy and its placement objects. The generated YAML is
+// written to stdout unless an output path is set and the logs are written to
+// stderr.
+func run(args []string, stdout, stderr io.Writer) error {
+	flags := pflag.NewFlagSet(path.Base(args[0]), pflag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	nsFlag := flags.StringP("namespace", "n", "", "the namespace for the policy")
+	nameFlag := flags.String("name", "", "the name for the policy")
+	configPolicyNameFlag := flags.String(
+		"configuration-policy-name", "",
+		"the name for the ConfigurationPolicy; defaults to the policy name",
+	)
+	clusterSelectors := flags.StringSlice(
+		"cluster-selectors", []string{},
+		"a comma-separated list of placement rule cluster selectors in the format of "+
+			"label=value (In), label!=value (NotIn), label (Exists), or !label (DoesNotExist); "+
+			"a label provided multiple times with the same operator matches any of its values; "+
+			"if not provided, the placement rule will be for all clusters; does not take effect "+
+			"if --placement is set",
+	)
+	clusterConditions := flags.StringSlice(
+		"cluster-conditions", []string{"ManagedClusterConditionAvailable=True"},
+		"a comma-separated list of placement rule cluster conditions in the format of "+
+			"type=status; set to an empty string for no cluster conditions; does not take effect "+
+			"if --placement is set",
+	)
+	outputFlag := flags.StringP(
+		"output", "o", "", "the path to write the policy to; defaults to stdout",
+	)
+	outputDirFlag := flags.String(
+		"output-dir", "",
+		"the directory to write the policy and its placement objects to as <name>.yaml; "+
+			"cannot be set with --output",
+	)
+	outputModeFlag := flags.String(
+		"output-mode", "0644",
+		"the octal file mode to use when writing the policy to --output or --output-dir",
+	)
+	reportFlag := flags.String(
+		"report", "",
+		"the path to write a JSON report of the generated policy and its placement objects to",
+	)
+	placementFlag := flags.String(
+		"placement", "",
+		"the path to the placement rule to use; takes precedence over --cluster-selectors",
+	)
+	placementRuleNameFlag := flags.String(
+		"placement-rule-name", "",
+		"the name of the placement rule to use from --placement when the file has multiple "+
+			"placement rules; defaults to the first placement rule",
 	)
-	patches := pflag.StringSliceP(
+	requireSelectorsFlag := flags.Bool(
+		"require-selectors", false,
+		"whether to fail instead of generating a placement rule for all clusters when neither "+
+			"--cluster-selectors nor --placement is set",
+	)
+	placementBindingFlag := flags.String(
+		"placement-binding", "",
+		"the path to an existing placement binding to use instead of generating one; it must "+
+			"reference the placement rule and have the policy as a subject",
+	)
+	placementNamePatternFlag := flags.String(
+		"placement-name-pattern", "placement-"+placementNamePlaceholder,
+		"the pattern of the generated placement rule name where "+placementNamePlaceholder+
+			" is replaced with the policy name",
+	)
+	placementAPIVersionFlag := flags.String(
+		"placement-api-version", placementRuleAPIVersion,
+		"the group/version of the generated placement rule; the placement binding's "+
+			"placementRef uses its group",
+	)
+	patches := flags.StringSliceP(
 		"patches", "p", []string{}, "a comma-separated list of Kustomize-like patches",
 	)
-	categories := pflag.StringSlice(
+	categories := flags.StringSlice(
 		"categories", stringList{"CM Configuration Management"},
 		"a comma-separated list of the policy's categories",
 	)
-	controls := pflag.StringSlice(
+	controls := flags.StringSlice(
 		"controls", stringList{"CM-2 Baseline Configuration"},
 		"a comma-separated list of the policy's controls",
 	)
-	standards := pflag.StringSlice(
+	standards := flags.StringSlice(
 		"standards", stringList{"NIST SP 800-53"},
 		"a comma-separated list of the policy's standards",
 	)
-	disabledFlag := pflag.Bool("disabled", true, "whether the policy is disabled")
-	remediationActionFlag := pflag.String(
+	standardAnnotationsFlag := flags.Bool(
+		"standard-annotations", true,
+		"whether to add the categories, controls, and standards annotations to the policy with "+
+			"their default values; when false, they are only added if their flag is set",
+	)
+	dependencies := flags.StringSlice(
+		"dependencies", []string{},
+		"a comma-separated list of policies that must reach a compliance state before this "+
+			"policy is evaluated, in the format of namespace/name[=complianceState]; the compliance "+
+			"state defaults to Compliant",
+	)
+	disabledFlag := flags.Bool("disabled", true, "whether the policy is disabled")
+	remediationActionFlag := flags.String(
 		"remediationAction", "inform", "the policy's remediation action (inform or enforce)",
 	)
-	severityFlag := pflag.String("severity", "low", "the policy's severity (high, medium, or low)")
-	pflag.Parse()
+	acceptLegacyActionsFlag := flags.Bool(
+		"accept-legacy-actions", false,
+		"whether to accept the legacy remediation actions of audit and remediate as aliases "+
+			"for inform and enforce",
+	)
+	severityFlag := flags.String(
+		"severity", "low", "the policy's severity (critical, high, medium, or low)",
+	)
+	recordDiffFlag := flags.String(
+		"record-diff", "",
+		"where the ConfigurationPolicy records the diff between the desired and actual objects "+
+			"(Log, InStatus, or None); spec.recordDiff is only set if this flag is set",
+	)
+	copyManifestLabelsFlag := flags.Bool(
+		"copy-manifest-labels", false,
+		"whether to copy the labels of the first object in the first object manifest onto the "+
+			"policy",
+	)
+	timestampAnnotationFlag := flags.Bool(
+		"timestamp-annotation", false,
+		"whether to add a generation timestamp annotation to the policy; the timestamp comes "+
+			"from --timestamp or the SOURCE_DATE_EPOCH environment variable",
+	)
+	timestampFlag := flags.String(
+		"timestamp", "", "the RFC 3339 generation timestamp used by --timestamp-annotation",
+	)
+	objectTemplatesRawFlag := flags.Bool(
+		"object-templates-raw", false,
+		"whether to embed the object manifests as is in the ConfigurationPolicy's "+
+			"object-templates-raw instead of parsing them into object-templates",
+	)
+	injectNamespaceFlag := flags.Bool(
+		"inject-namespace", false,
+		"whether to set the policy namespace on the objects wrapped in the ConfigurationPolicy "+
+			"that don't have a namespace set; well-known cluster-scoped kinds such as ClusterRole "+
+			"are skipped, but custom cluster-scoped kinds aren't detected, so only use this with "+
+			"namespaced custom resources",
+	)
+	dedupManifestsFlag := flags.Bool(
+		"dedup-manifests", false,
+		"whether to only keep the first occurrence of an object with the same kind, API group, "+
+			"namespace, and name in the object manifests instead of failing; does not take "+
+			"effect if --object-templates-raw is set",
+	)
+	copyPolicyMetadataFlag := flags.Bool(
+		"copy-policy-metadata", false,
+		"whether the ConfigurationPolicy should copy the policy's labels and annotations onto "+
+			"the objects it manages; spec.copyPolicyMetadata is only set if this flag is set",
+	)
+	sanitizeManifestsFlag := flags.Bool(
+		"sanitize-manifests", false,
+		"whether to remove the status and the metadata fields set by the API server, such as "+
+			"managedFields and resourceVersion, from the object manifests; does not take effect "+
+			"if --object-templates-raw is set",
+	)
+	disableTemplatesFlag := flags.Bool(
+		"disable-templates", false,
+		"whether the policy controller should not process templates in the policy; when set, "+
+			"the "+defaultAnnotationPrefix+"/"+disableTemplatesAnnotation+" annotation is added to "+
+			"the policy",
+	)
+	labelManagedFlag := flags.Bool(
+		"label-managed", false,
+		"whether to add the "+generatedByLabel+"="+generatedByValue+" label and the "+
+			defaultAnnotationPrefix+"/"+configHashAnnotation+" annotation to the generated "+
+			"policy, placement rule, and placement binding",
+	)
+	annotationPrefixFlag := flags.String(
+		"annotation-prefix", defaultAnnotationPrefix,
+		"the prefix of the annotation keys set on the policy such as the categories, controls, "+
+			"and standards annotations",
+	)
+	inheritAnnotationsFlag := flags.StringSlice(
+		"inherit-annotations", []string{},
+		"a comma-separated list of annotation keys to copy from the first object in the first "+
+			"object manifest onto the policy; they take precedence over --categories, --controls, "+
+			"and --standards",
+	)
+	validateCmdFlag := flags.String(
+		"validate-cmd", "",
+		"a command run with sh -c that receives the generated YAML on stdin before it is "+
+			"written; the generation fails if the command exits with a non-zero code",
+	)
+	placementOnlyFlag := flags.Bool(
+		"placement-only", false,
+		"whether to only output the placement rule and placement binding without the policy; "+
+			"the object manifests are still read but aren't output and the patches are ignored",
+	)
+	createNamespaceFlag := flags.Bool(
+		"create-namespace", false,
+		"whether to output a Namespace object for the policy namespace before the policy",
+	)
+	noHeaderFlag := flags.Bool(
+		"no-header", false, "whether to skip the autogenerated comment header",
+	)
+	headerSeparatorFlag := flags.Bool(
+		"header-separator", true,
+		"whether to add a YAML document separator before the policy, after the comment "+
+			"header if present",
+	)
+	indentFlag := flags.Int(
+		"indent", 2, "the number of spaces to indent the output YAML with (between 2 and 9)",
+	)
+	maxPolicyBytesFlag := flags.Int(
+		"max-policy-bytes", 0,
+		"the maximum size in bytes of the generated policy YAML with the --indent indentation; "+
+			"0 means unlimited",
+	)
+	validateFlag := flags.Bool(
+		"validate", false,
+		"whether to only validate the flags and the generated objects without writing any "+
+			"output; OK is printed if they are valid",
+	)
+	verboseFlag := flags.CountP(
+		"verbose", "v",
+		"the level of the logs written to stderr; -v logs the policy and placement resolution and "+
+			"-vv also logs each object manifest read",
+	)
+	versionFlag := flags.Bool("version", false, "print the version information and exit")
+	err := flags.Parse(args[1:])
+	if errors.Is(err, pflag.ErrHelp) {
+		return nil
+	} else if err != nil {
+		fmt.Fprintf(stderr, "Usage of %s:\n%s", args[0], flags.FlagUsages())
+
+		return err
+	}
+
+	logger := verboseLogger{verbosity: *verboseFlag, out: stderr}
+
+	if *versionFlag {
+		fmt.Fprintf(
+			stdout,
+			"%s version %s\nGo version: %s\nBuild date: %s\n",
+			path.Base(args[0]),
+			version,
+			runtime.Version(),
+			buildDate,
+		)
+
+		return nil
+	}
+
+	policyRemAction := *remediationActionFlag
+	if *acceptLegacyActionsFlag {
+		policyRemAction = normalizeLegacyRemediationAction(policyRemAction)
+	}
+
+	configPolicyName := *configPolicyNameFlag
+	if configPolicyName == "" {
+		configPolicyName = *nameFlag
+	}
+
+	placement := placementOptions{
+		policyNamespace:   *nsFlag,
+		policyName:        *nameFlag,
+		path:              *placementFlag,
+		ruleName:          *placementRuleNameFlag,
+		bindingPath:       *placementBindingFlag,
+		namePattern:       *placementNamePatternFlag,
+		apiVersion:        *placementAPIVersionFlag,
+		clusterSelectors:  *clusterSelectors,
+		clusterConditions: *clusterConditions,
+		requireSelectors:  *requireSelectorsFlag,
+	}
+
+	err = assertValidFlags(flagOptions{
+		policyNamespace:    *nsFlag,
+		policyName:         *nameFlag,
+		configPolicyName:   configPolicyName,
+		remAction:          policyRemAction,
+		severity:           *severityFlag,
+		recordDiff:         *recordDiffFlag,
+		outputPath:         *outputFlag,
+		outputDir:          *outputDirFlag,
+		outputMode:         *outputModeFlag,
+		annotationPrefix:   *annotationPrefixFlag,
+		indent:             *indentFlag,
+		maxPolicyBytes:     *maxPolicyBytesFlag,
+		dependencies:       *dependencies,
+		inheritAnnotations: *inheritAnnotationsFlag,
+		patches:            *patches,
+		objDefPaths:        flags.Args(),
+		placement:          placement,
+	})
+	if err != nil {
+		return err
+	}
 
-	assertValidFlags(*nsFlag, *nameFlag, *placementFlag, *clusterSelectors, *patches, pflag.Args())
+	// The remediation action is validated case-insensitively, but the CRDs only accept the
+	// lowercase or capitalized forms
+	policyRemAction = strings.ToLower(policyRemAction)
 
 	policyNamespace := *nsFlag
 	policyName := *nameFlag
 	outputPath := *outputFlag
+	validateOnly := *validateFlag
+	if *outputDirFlag != "" && !validateOnly {
+		outputPath = path.Join(*outputDirFlag, policyName+".yaml")
+		err := os.MkdirAll(*outputDirFlag, 0755)
+		if err != nil {
+			return fmt.Errorf("failed to create the output directory %s: %v", *outputDirFlag, err)
+		}
+	}
+
+	outputMode, err := parseFileMode(*outputModeFlag)
+	// An error shouldn't be possible since it was validated in the assertValidFlags function
+	if err != nil {
+		panic(err)
+	}
+
 	policyDisabled := *disabledFlag
-	policyRemAction := *remediationActionFlag
 	policySeverity := *severityFlag
+	recordDiff := *recordDiffFlag
 	placementPath := *placementFlag
-	objDefPaths := pflag.Args()
-
-	policyAnnotations := map[string]string{
-		"policy.open-cluster-management.io/categories": strings.Join(*categories, ","),
-		"policy.open-cluster-management.io/controls":   strings.Join(*controls, ","),
-		"policy.open-cluster-management.io/standards":  strings.Join(*standards, ","),
+	reportPath := *reportFlag
+	placementBindingPath := *placementBindingFlag
+	noHeader := *noHeaderFlag
+	headerSeparator := *headerSeparatorFlag
+	copyManifestLabels := *copyManifestLabelsFlag
+	addTimestamp := *timestampAnnotationFlag
+	objectTemplatesRaw := *objectTemplatesRawFlag
+	injectNamespace := *injectNamespaceFlag
+	sanitizeManifests := *sanitizeManifestsFlag
+	dedupManifests := *dedupManifestsFlag
+	var copyPolicyMetadata *bool
+	if flags.Changed("copy-policy-metadata") {
+		copyPolicyMetadata = copyPolicyMetadataFlag
 	}
-
-	k := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
-	// Create the file system in memory with the Kustomize YAML files
-	fSys := filesys.MakeFsInMemory()
-	fSys.Mkdir(kustomizeDir)
-
-	configPolicyBase := getPolicyConfigBase(policyName, policyNamespace)
-	configPolicyBaseBytes, err := yaml.Marshal(configPolicyBase)
+	createNamespace := *createNamespaceFlag
+	labelManaged := *labelManagedFlag
+	annotationPrefix := *annotationPrefixFlag
+	addStandardAnnotations := *standardAnnotationsFlag
+	placementOnly := *placementOnlyFlag
+	validateCmd := *validateCmdFlag
+	indent := *indentFlag
+	maxPolicyBytes := *maxPolicyBytesFlag
+	var objDefPaths []string
+	objDefPaths, err = expandObjDefPaths(flags.Args())
 	if err != nil {
-		errorAndExit("Failed to convert the configuration policy to YAML")
+		return err
 	}
 
-	err = fSys.WriteFile(path.Join(kustomizeDir, "configurationpolicy.yaml"), configPolicyBaseBytes)
-	if err != nil {
-		errorAndExit("Failed to load the create configuration policy YAML file in memory: %v", err)
+	documents := []interface{}{}
+	if createNamespace {
+		documents = append(documents, map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Namespace",
+			"metadata": map[string]interface{}{
+				"name": policyNamespace,
+			},
+		})
 	}
 
 	objDefsBytes := [][]byte{}
 	for _, objDefPath := range objDefPaths {
-		objDefBytes, err := ioutil.ReadFile(objDefPath)
-		if err != nil {
-			errorAndExit("Failed to read %s", objDefPath)
+		var objDefBytes []byte
+		if objDefPath == stdinPath {
+			objDefBytes, err = io.ReadAll(os.Stdin)
+			if err != nil {
+				return fmt.Errorf("failed to read the object manifest from stdin: %v", err)
+			}
+
+			logger.log(2, "Read the object manifest from stdin")
+		} else if info, err := os.Stat(objDefPath); err == nil && info.IsDir() {
+			objDefBytes, err = runKustomizeBuild(objDefPath)
+			if err != nil {
+				return fmt.Errorf("executing kustomize on %s failed: %v", objDefPath, err)
+			}
+
+			logger.log(2, "Built the object manifest directory %s with Kustomize", objDefPath)
+		} else {
+			objDefBytes, err = ioutil.ReadFile(objDefPath)
+			if err != nil {
+				return fmt.Errorf("failed to read %s", objDefPath)
+			}
+
+			logger.log(2, "Read the object manifest %s", objDefPath)
+		}
+
+		// Report decoding errors such as duplicate keys with the path of the object
+		// manifest. Raw object manifests are embedded as is and may not be valid YAML.
+		if !objectTemplatesRaw {
+			if _, err := unmarshalObjDefFile(objDefBytes); err != nil {
+				return fmt.Errorf("the object manifest %s is invalid: %v", objDefPath, err)
+			}
 		}
 
 		objDefsBytes = append(objDefsBytes, objDefBytes)
 	}
 
-	patch, err := createPatchFromK8sObjects(
-		policyName,
-		policyNamespace,
-		policyRemAction,
-		policySeverity,
-		&policyAnnotations,
-		policyDisabled,
-		&objDefsBytes,
-	)
-	if err != nil {
-		errorAndExit("Failed to create a policy: %v", err)
+	var generationTimestamp string
+	if addTimestamp {
+		generationTimestamp, err = getGenerationTimestamp(*timestampFlag)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = fSys.WriteFile(path.Join(kustomizeDir, basePatchFilename), patch)
-	if err != nil {
-		errorAndExit("Failed to load %s in memory: %v", basePatchFilename, err)
+	var configHash string
+	if labelManaged {
+		resolvedFlags := map[string]string{
+			"remediationAction":         policyRemAction,
+			"configuration-policy-name": configPolicyName,
+			"timestamp":                 generationTimestamp,
+		}
+		// These flags only take effect when they are set
+		for _, flagName := range []string{"copy-policy-metadata", "disable-templates"} {
+			if !flags.Changed(flagName) {
+				resolvedFlags[flagName] = ""
+			}
+		}
+
+		for _, flagName := range []string{"categories", "controls", "standards"} {
+			if !addStandardAnnotations && !flags.Changed(flagName) {
+				resolvedFlags[flagName] = ""
+			}
+		}
+
+		configHash, err = getConfigHash(
+			flags,
+			resolvedFlags,
+			&objDefsBytes,
+			*patches,
+			placementPath,
+			placementBindingPath,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to calculate the config hash: %v", err)
+		}
 	}
 
-	err = prepareKustomizationEnv(fSys, *patches, policyNamespace, policyName)
-	if err != nil {
-		// Indexing is safe here since the error message is always ASCII
-		errMsg := strings.ToUpper(string(err.Error()[0])) + string(err.Error()[1:])
-		errorAndExit(errMsg)
+	if !placementOnly {
+		logger.log(1, "Generating the policy %s in the namespace %s", policyName, policyNamespace)
+
+		var policyYAML []byte
+		policyAnnotations := map[string]string{}
+		standardAnnotations := map[string]*[]string{
+			"categories": categories,
+			"controls":   controls,
+			"standards":  standards,
+		}
+		for flagName, values := range standardAnnotations {
+			// Without the standard annotations, only the ones explicitly provided are set
+			if !addStandardAnnotations && !flags.Changed(flagName) {
+				continue
+			}
+
+			policyAnnotations[annotationPrefix+"/"+flagName] = strings.Join(*values, ",")
+		}
+
+		if flags.Changed("disable-templates") {
+			policyAnnotations[annotationPrefix+"/"+disableTemplatesAnnotation] = strconv.FormatBool(
+				*disableTemplatesFlag,
+			)
+		}
+
+		if addTimestamp {
+			policyAnnotations[annotationPrefix+"/"+timestampAnnotation] = generationTimestamp
+		}
+
+		k := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+		// Create the file system in memory with the Kustomize YAML files
+		fSys := filesys.MakeFsInMemory()
+		fSys.Mkdir(kustomizeDir)
+
+		configPolicyBase := getPolicyConfigBase(policyName, policyNamespace)
+		configPolicyBaseBytes, err := yaml.Marshal(configPolicyBase)
+		if err != nil {
+			return fmt.Errorf("failed to convert the configuration policy to YAML")
+		}
+
+		err = fSys.WriteFile(
+			path.Join(kustomizeDir, "configurationpolicy.yaml"), configPolicyBaseBytes,
+		)
+		if err != nil {
+			return fmt.Errorf(
+				"failed to load the create configuration policy YAML file in memory: %v", err,
+			)
+		}
+
+		inheritedAnnotations, err := getInheritedAnnotations(&objDefsBytes, *inheritAnnotationsFlag)
+		if err != nil {
+			return fmt.Errorf("failed to inherit the object manifest annotations: %v", err)
+		}
+
+		for key, value := range inheritedAnnotations {
+			policyAnnotations[key] = value
+		}
+
+		policyLabels := map[string]string{}
+		if copyManifestLabels {
+			policyLabels, err = getCopiedManifestLabels(&objDefsBytes, *patches)
+			if err != nil {
+				return fmt.Errorf("failed to copy the object manifest labels: %v", err)
+			}
+		}
+
+		if labelManaged {
+			policyLabels[generatedByLabel] = generatedByValue
+			policyAnnotations[annotationPrefix+"/"+configHashAnnotation] = configHash
+		}
+
+		policyDependencies := getDependencies(*dependencies)
+
+		patch, err := createPatchFromK8sObjects(
+			policyOptions{
+				name:               policyName,
+				namespace:          policyNamespace,
+				configPolicyName:   configPolicyName,
+				remAction:          policyRemAction,
+				severity:           policySeverity,
+				recordDiff:         recordDiff,
+				annotations:        policyAnnotations,
+				labels:             policyLabels,
+				disabled:           policyDisabled,
+				dependencies:       policyDependencies,
+				raw:                objectTemplatesRaw,
+				injectNamespace:    injectNamespace,
+				sanitize:           sanitizeManifests,
+				dedup:              dedupManifests,
+				copyPolicyMetadata: copyPolicyMetadata,
+			},
+			&objDefsBytes,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create a policy: %v", err)
+		}
+
+		err = fSys.WriteFile(path.Join(kustomizeDir, basePatchFilename), patch)
+		if err != nil {
+			return fmt.Errorf("failed to load %s in memory: %v", basePatchFilename, err)
+		}
+
+		err = prepareKustomizationEnv(fSys, *patches, policyNamespace, policyName)
+		if err != nil {
+			return err
+		}
+
+		m, err := k.Run(fSys, kustomizeDir)
+		if err != nil {
+			return fmt.Errorf("executing kustomize failed: %v", err)
+		}
+
+		policyYAML, err = m.AsYaml()
+		if err != nil {
+			return fmt.Errorf("could not convert the configuration policy to YAML: %v", err)
+		}
+
+		policyDocuments, err := decodeYAMLDocuments(policyYAML)
+		if err != nil {
+			return fmt.Errorf("could not decode the policy YAML: %v", err)
+		}
+
+		if maxPolicyBytes != 0 {
+			// Measure the policy as it is output since the indentation changes its size
+			outputPolicyYAML, err := encodeYAMLDocuments(policyDocuments, indent)
+			if err != nil {
+				return fmt.Errorf("could not convert the policy to YAML: %v", err)
+			}
+
+			if len(outputPolicyYAML) > maxPolicyBytes {
+				return fmt.Errorf(
+					"the policy %s is %d bytes which exceeds the --max-policy-bytes limit of %d "+
+						"bytes",
+					policyName,
+					len(outputPolicyYAML),
+					maxPolicyBytes,
+				)
+			}
+		}
+		documents = append(documents, policyDocuments...)
 	}
 
-	m, err := k.Run(fSys, kustomizeDir)
+	placementObjects, placementRuleName, bindingName, err := getPlacementObjects(placement)
 	if err != nil {
-		errorAndExit("Executing kustomize failed: %v", err)
+		return fmt.Errorf("failed to generate the placement binding/rule: %v", err)
 	}
 
-	policyYAML, err := m.AsYaml()
-	if err != nil {
-		errorAndExit("Could not convert the configuration policy to YAML: %v", err)
+	if placementPath != "" {
+		logger.log(1, "Using the placement rule %s from %s", placementRuleName, placementPath)
+	} else {
+		logger.log(1, "Generating the placement rule %s", placementRuleName)
 	}
 
-	allYAML := addCommentHeader(&policyYAML)
-	allYAML, err = addPlacementObjects(
-		allYAML, policyNamespace, policyName, placementPath, *clusterSelectors,
-	)
+	if placementBindingPath != "" {
+		logger.log(1, "Using the placement binding %s from %s", bindingName, placementBindingPath)
+	} else {
+		logger.log(1, "Generating the placement binding %s", bindingName)
+	}
+
+	if labelManaged {
+		addManagedMetadata(placementObjects, annotationPrefix, configHash)
+	}
+	documents = append(documents, placementObjects...)
 
+	outputYAML, err := encodeYAMLDocuments(documents, indent)
 	if err != nil {
-		errorAndExit("Failed to generate the placement binding/rule: %v", err)
+		return fmt.Errorf("could not convert the generated objects to YAML: %v", err)
+	}
+
+	allYAML := &outputYAML
+	if !noHeader {
+		allYAML = addCommentHeader(allYAML, args, headerSeparator)
+	} else if headerSeparator {
+		separatedYAML := append([]byte("---\n"), outputYAML...)
+		allYAML = &separatedYAML
+	}
+
+	if validateCmd != "" {
+		err = runValidateCommand(validateCmd, *allYAML)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Everything is generated and validated before this point so only the output is skipped
+	if validateOnly {
+		fmt.Fprintln(stdout, "OK")
+
+		return nil
+	}
+
+	if reportPath != "" {
+		err = writeReport(reportPath, []policyReport{
+			{
+				Name:             policyName,
+				Namespace:        policyNamespace,
+				Placement:        placementRuleName,
+				PlacementBinding: bindingName,
+			},
+		})
+		if err != nil {
+			return err
+		}
 	}
 
 	if outputPath != "" {
-		os.WriteFile(outputPath, *allYAML, 0444)
+		err = os.WriteFile(outputPath, *allYAML, outputMode)
+		if err != nil {
+			return fmt.Errorf("failed to write the policy to %s: %v", outputPath, err)
+		}
+
+		// The mode passed to WriteFile is only used when the file is created and is masked by
+		// the umask
+		err = os.Chmod(outputPath, outputMode)
+		if err != nil {
+			return fmt.Errorf("failed to set the mode of %s: %v", outputPath, err)
+		}
+
+		logger.log(1, "Wrote the generated YAML to %s", outputPath)
 	} else {
-		fmt.Println(string(*allYAML))
+		fmt.Fprintln(stdout, string(*allYAML))
+	}
+
+	return nil
+}
+
+func main() {
+	err := run(os.Args, os.Stdout, os.Stderr)
+	if err != nil {
+		errorAndExit(capitalizeError(err))
 	}
 }
@@ -0,0 +1,2553 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const testConfigMap = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: my-config
+data:
+  key: value
+`
+
+const testConstraintTemplate = `apiVersion: templates.gatekeeper.sh/v1beta1
+kind: ConstraintTemplate
+metadata:
+  name: k8srequiredlabels
+`
+
+const testConstraint = `apiVersion: constraints.gatekeeper.sh/v1beta1
+kind: K8sRequiredLabels
+metadata:
+  name: ns-must-have-owner
+`
+
+// runGenerator runs the generator with the input arguments and returns its
+// stdout and stderr.
+func runGenerator(t *testing.T, args ...string) (string, string, error) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	err := run(append([]string{"policy-generator"}, args...), &stdout, &stderr)
+
+	return stdout.String(), stderr.String(), err
+}
+
+// writeTestFile writes the input contents to the file with the input name in
+// the input directory and returns its path.
+func writeTestFile(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+
+	filePath := path.Join(dir, name)
+	err := os.WriteFile(filePath, []byte(contents), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write %s: %v", filePath, err)
+	}
+
+	return filePath
+}
+
+// decodeDocuments decodes the input YAML documents into objects.
+func decodeDocuments(t *testing.T, yamlDocuments string) []map[string]interface{} {
+	t.Helper()
+
+	documents := []map[string]interface{}{}
+	decoder := yaml.NewDecoder(strings.NewReader(yamlDocuments))
+	for {
+		var document map[string]interface{}
+		err := decoder.Decode(&document)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("Failed to decode the YAML documents: %v", err)
+		}
+
+		documents = append(documents, document)
+	}
+
+	return documents
+}
+
+// getField returns the nested field of the input object. NestedFieldNoCopy is
+// used since the other helpers panic when deep copying the int values from
+// yaml.v3.
+func getField(obj map[string]interface{}, fields ...string) interface{} {
+	value, _, _ := unstructured.NestedFieldNoCopy(obj, fields...)
+
+	return value
+}
+
+// getPolicyTemplateKinds returns the kinds of the policy-templates in the input
+// policy in order.
+func getPolicyTemplateKinds(policy map[string]interface{}) []string {
+	kinds := []string{}
+	policyTemplates, _ := getField(policy, "spec", "policy-templates").([]interface{})
+	for _, policyTemplate := range policyTemplates {
+		kind, _ := getField(
+			policyTemplate.(map[string]interface{}), "objectDefinition", "kind",
+		).(string)
+		kinds = append(kinds, kind)
+	}
+
+	return kinds
+}
+
+func getTestPolicyOptions() policyOptions {
+	return policyOptions{
+		name:             "my-policy",
+		namespace:        "my-policies",
+		configPolicyName: "my-policy",
+		remAction:        "inform",
+		severity:         "low",
+		annotations:      map[string]string{},
+		labels:           map[string]string{},
+		dependencies:     []map[string]string{},
+	}
+}
+
+func TestCreatePatchFromK8sObjectsRouting(t *testing.T) {
+	tests := []struct {
+		name     string
+		objDefs  []string
+		expected []string
+	}{
+		{"ConfigurationPolicy only", []string{testConfigMap}, []string{"ConfigurationPolicy"}},
+		{
+			"mixed Gatekeeper manifest",
+			[]string{testConfigMap + "---\n" + testConstraintTemplate},
+			[]string{"ConfigurationPolicy", "ConstraintTemplate"},
+		},
+		{
+			"Gatekeeper only",
+			[]string{testConstraintTemplate, testConstraint},
+			[]string{"ConstraintTemplate", "K8sRequiredLabels"},
+		},
+	}
+
+	for _, test := range tests {
+		objDefFiles := [][]byte{}
+		for _, objDef := range test.objDefs {
+			objDefFiles = append(objDefFiles, []byte(objDef))
+		}
+
+		patch, err := createPatchFromK8sObjects(getTestPolicyOptions(), &objDefFiles)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+
+		kinds := getPolicyTemplateKinds(decodeDocuments(t, string(patch))[0])
+		if !reflect.DeepEqual(kinds, test.expected) {
+			t.Errorf(
+				"%s: got the policy-templates %v; expected %v", test.name, kinds, test.expected,
+			)
+		}
+	}
+}
+
+func TestRunMixedGatekeeperManifest(t *testing.T) {
+	manifestPath := writeTestFile(
+		t,
+		t.TempDir(),
+		"manifest.yaml",
+		testConfigMap+"---\n"+testConstraintTemplate+"---\n"+testConstraint,
+	)
+
+	stdout, _, err := runGenerator(
+		t, "--namespace", "my-policies", "--name", "my-policy", manifestPath,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	policy := decodeDocuments(t, stdout)[0]
+	kinds := getPolicyTemplateKinds(policy)
+	expected := []string{"ConfigurationPolicy", "ConstraintTemplate", "K8sRequiredLabels"}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Fatalf("Got the policy-templates %v; expected %v", kinds, expected)
+	}
+
+	policyTemplates := getField(policy, "spec", "policy-templates").([]interface{})
+	objectTemplates := getField(
+		policyTemplates[0].(map[string]interface{}), "objectDefinition", "spec", "object-templates",
+	).([]interface{})
+	if len(objectTemplates) != 1 ||
+		objectTemplates[0].(map[string]interface{})["kind"] != "ConfigMap" {
+		t.Errorf("Expected only the ConfigMap to be wrapped but got %v", objectTemplates)
+	}
+}
+
+func TestRunAnnotationPrefix(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	stdout, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--annotation-prefix", "policy.example.com",
+		"--disable-templates",
+		manifestPath,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	annotations := getField(decodeDocuments(t, stdout)[0], "metadata", "annotations")
+	expected := map[string]interface{}{
+		"policy.example.com/categories":        "CM Configuration Management",
+		"policy.example.com/controls":          "CM-2 Baseline Configuration",
+		"policy.example.com/standards":         "NIST SP 800-53",
+		"policy.example.com/disable-templates": "true",
+	}
+	if !reflect.DeepEqual(annotations, expected) {
+		t.Errorf("Got the annotations %v; expected %v", annotations, expected)
+	}
+
+	_, _, err = runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--annotation-prefix", "Not_A_Prefix",
+		manifestPath,
+	)
+	errMsg := `the annotation prefix "Not_A_Prefix" is invalid`
+	if err == nil || !strings.Contains(err.Error(), errMsg) {
+		t.Errorf(`Expected an error containing "%s" but got %v`, errMsg, err)
+	}
+}
+
+// unsetSourceDateEpoch unsets the SOURCE_DATE_EPOCH environment variable and
+// returns a function that restores it.
+func unsetSourceDateEpoch() func() {
+	sourceDateEpoch, set := os.LookupEnv("SOURCE_DATE_EPOCH")
+	os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	return func() {
+		if set {
+			os.Setenv("SOURCE_DATE_EPOCH", sourceDateEpoch)
+		} else {
+			os.Unsetenv("SOURCE_DATE_EPOCH")
+		}
+	}
+}
+
+func TestRunValidate(t *testing.T) {
+	defer unsetSourceDateEpoch()()
+
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "configmap.yaml", testConfigMap)
+	policyManifestPath := writeTestFile(
+		t,
+		dir,
+		"policy.yaml",
+		"apiVersion: policy.open-cluster-management.io/v1\nkind: Policy\nmetadata:\n  name: p\n",
+	)
+	iamPolicyPath := writeTestFile(
+		t,
+		dir,
+		"iampolicy.yaml",
+		"apiVersion: policy.open-cluster-management.io/v1\nkind: IamPolicy\nmetadata:\n"+
+			"  name: my-iam-policy\nspec:\n  maxClusterRoleBindingUsers: -1\n",
+	)
+	duplicatePath := writeTestFile(
+		t, dir, "duplicate.yaml", testConfigMap+"---\n"+testConfigMap,
+	)
+	bindingPath := writeTestFile(
+		t,
+		dir,
+		"binding.yaml",
+		"apiVersion: policy.open-cluster-management.io/v1\nkind: PlacementBinding\nmetadata:\n"+
+			"  name: my-binding\n  namespace: other\n",
+	)
+	patchPath := writeTestFile(t, dir, "patch.yaml", "kind: Foo\n")
+	outputDir := path.Join(dir, "output")
+	outputPath := path.Join(dir, "policy.yaml.out")
+
+	tests := []struct {
+		name   string
+		args   []string
+		errMsg string
+	}{
+		{"valid", []string{manifestPath}, ""},
+		{"invalid flag", []string{"--severity", "extreme", manifestPath}, `the severity "extreme"`},
+		{"Policy manifest", []string{policyManifestPath}, "is a Policy which can't be wrapped"},
+		{"invalid IamPolicy", []string{iamPolicyPath}, "spec.maxClusterRoleBindingUsers"},
+		{"duplicate objects", []string{duplicatePath}, "more than once"},
+		{
+			"placement binding in the wrong namespace",
+			[]string{"--placement-binding", bindingPath, manifestPath},
+			"must be in the policy namespace my-policies",
+		},
+		{
+			"timestamp annotation without a timestamp",
+			[]string{"--timestamp-annotation", manifestPath},
+			"the SOURCE_DATE_EPOCH environment variable must be set",
+		},
+		{
+			"patch with an invalid kind",
+			[]string{"--patches", patchPath, manifestPath},
+			"patches must have kind not be set or set to Policy",
+		},
+	}
+
+	for _, test := range tests {
+		args := []string{
+			"--namespace", "my-policies",
+			"--name", "my-policy",
+			"--validate",
+			"--output-dir", outputDir,
+		}
+		stdout, _, err := runGenerator(t, append(args, test.args...)...)
+		if test.errMsg == "" {
+			if err != nil || stdout != "OK\n" {
+				t.Errorf(`%s: got %q, %v; expected "OK"`, test.name, stdout, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+			t.Errorf(
+				`%s: expected an error containing "%s" but got %v`, test.name, test.errMsg, err,
+			)
+		}
+
+		if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+			t.Fatalf("%s: expected the output directory to not be created", test.name)
+		}
+	}
+
+	stdout, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--validate",
+		"-o", outputPath,
+		manifestPath,
+	)
+	if err != nil || stdout != "OK\n" {
+		t.Errorf(`Got %q, %v; expected "OK"`, stdout, err)
+	}
+
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Error("Expected the output file to not be written")
+	}
+}
+
+func TestParseFileMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected os.FileMode
+		valid    bool
+	}{
+		{"0644", 0644, true},
+		{"600", 0600, true},
+		{"0777", 0777, true},
+		{"1777", 0, false},
+		{"0999", 0, false},
+		{"rw-r--r--", 0, false},
+	}
+
+	for _, test := range tests {
+		mode, err := parseFileMode(test.mode)
+		if test.valid && (err != nil || mode != test.expected) {
+			t.Errorf(
+				`parseFileMode("%s") = %o, %v; expected %o`, test.mode, mode, err, test.expected,
+			)
+		}
+
+		if !test.valid && err == nil {
+			t.Errorf(`parseFileMode("%s") expected an error`, test.mode)
+		}
+	}
+}
+
+func TestRunOutputMode(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "configmap.yaml", testConfigMap)
+	outputPath := path.Join(dir, "policy.yaml")
+
+	// The modes are written in order to the same file to check that an existing file's mode is
+	// updated and that the umask doesn't apply
+	for _, mode := range []os.FileMode{0600, 0640, 0666} {
+		_, _, err := runGenerator(
+			t,
+			"--namespace", "my-policies",
+			"--name", "my-policy",
+			"-o", outputPath,
+			"--output-mode", "0"+strconv.FormatUint(uint64(mode), 8),
+			manifestPath,
+		)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		info, err := os.Stat(outputPath)
+		if err != nil {
+			t.Fatalf("Failed to stat the output file: %v", err)
+		}
+
+		if info.Mode().Perm() != mode {
+			t.Errorf("Got the mode %o; expected %o", info.Mode().Perm(), mode)
+		}
+	}
+
+	_, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"-o", path.Join(dir, "other.yaml"),
+		"--output-mode", "rw-r--r--",
+		manifestPath,
+	)
+	if err == nil || !strings.Contains(err.Error(), `the output mode "rw-r--r--" must be`) {
+		t.Errorf("Expected an invalid output mode error but got %v", err)
+	}
+}
+
+func TestRunStdinManifest(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create a pipe: %v", err)
+	}
+
+	stdin := os.Stdin
+	os.Stdin = reader
+	defer func() {
+		os.Stdin = stdin
+		reader.Close()
+	}()
+
+	_, err = writer.WriteString(testConfigMap)
+	if err != nil {
+		t.Fatalf("Failed to write to the pipe: %v", err)
+	}
+	writer.Close()
+
+	stdout, _, err := runGenerator(t, "--namespace", "my-policies", "--name", "my-policy", "-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	documents := decodeDocuments(t, stdout)
+	policyTemplates := getField(documents[0], "spec", "policy-templates").([]interface{})
+	objectTemplates := getField(
+		policyTemplates[0].(map[string]interface{}), "objectDefinition", "spec", "object-templates",
+	).([]interface{})
+	name := getField(objectTemplates[0].(map[string]interface{}), "metadata", "name")
+	if len(objectTemplates) != 1 || name != "my-config" {
+		t.Errorf("Expected the ConfigMap from stdin to be wrapped but got %v", objectTemplates)
+	}
+
+	_, _, err = runGenerator(t, "--namespace", "my-policies", "--name", "my-policy", "-", "-")
+	if err == nil || !strings.Contains(err.Error(), "can only be set once") {
+		t.Errorf("Expected an error for stdin being set twice but got %v", err)
+	}
+}
+
+func TestRunPlacementAPIVersion(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	stdout, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--placement-api-version", "apps.example.com/v1beta1",
+		manifestPath,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	documents := decodeDocuments(t, stdout)
+	if documents[1]["apiVersion"] != "apps.example.com/v1beta1" {
+		t.Errorf("Got the placement rule apiVersion %v", documents[1]["apiVersion"])
+	}
+
+	apiGroup := getField(documents[2], "placementRef", "apiGroup")
+	if apiGroup != "apps.example.com" {
+		t.Errorf("Got the placementRef apiGroup %v; expected apps.example.com", apiGroup)
+	}
+
+	subjects := getField(documents[2], "subjects").([]interface{})
+	apiGroup = subjects[0].(map[string]interface{})["apiGroup"]
+	if apiGroup != "policy.open-cluster-management.io" {
+		t.Errorf("Got the subject apiGroup %v", apiGroup)
+	}
+
+	for _, apiVersion := range []string{"apps.example.com", "apps.example.com/v1/extra"} {
+		_, _, err = runGenerator(
+			t,
+			"--namespace", "my-policies",
+			"--name", "my-policy",
+			"--placement-api-version", apiVersion,
+			manifestPath,
+		)
+		errMsg := `must be in the format of "group/version"`
+		if err == nil || !strings.Contains(err.Error(), errMsg) {
+			t.Errorf(`%s: expected an error containing "%s" but got %v`, apiVersion, errMsg, err)
+		}
+	}
+}
+
+func TestGetConfigHash(t *testing.T) {
+	patchPath := path.Join(t.TempDir(), "patch.yaml")
+	getHash := func(patch string, output string, resolvedFlags map[string]string) string {
+		t.Helper()
+
+		err := os.WriteFile(patchPath, []byte(patch), 0600)
+		if err != nil {
+			t.Fatalf("Failed to write the patch: %v", err)
+		}
+
+		flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		flags.String("namespace", "my-policies", "")
+		flags.String("remediationAction", "audit", "")
+		flags.String("output", output, "")
+		objDefFiles := [][]byte{[]byte(testConfigMap)}
+
+		hash, err := getConfigHash(
+			flags, resolvedFlags, &objDefFiles, []string{patchPath}, "", "",
+		)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		return hash
+	}
+
+	enforcePatch := "spec:\n  remediationAction: enforce\n"
+	hash := getHash(enforcePatch, "policy.yaml", nil)
+	if hash != getHash(enforcePatch, "policy.yaml", nil) {
+		t.Error("Expected the hash to be stable")
+	}
+
+	if hash != getHash(enforcePatch, "other.yaml", nil) {
+		t.Error("Expected the hash to not depend on the output path")
+	}
+
+	if hash == getHash("spec:\n  remediationAction: inform\n", "policy.yaml", nil) {
+		t.Error("Expected the hash to change when the patch contents change")
+	}
+
+	resolvedFlags := map[string]string{"remediationAction": "inform"}
+	if hash == getHash(enforcePatch, "policy.yaml", resolvedFlags) {
+		t.Error("Expected the hash to use the resolved flag value")
+	}
+}
+
+func TestRunLabelManaged(t *testing.T) {
+	defer unsetSourceDateEpoch()()
+
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "configmap.yaml", testConfigMap)
+	getHashes := func(args ...string) []string {
+		t.Helper()
+
+		args = append(
+			[]string{"--namespace", "my-policies", "--name", "my-policy", "--label-managed"},
+			append(args, manifestPath)...,
+		)
+		stdout, _, err := runGenerator(t, args...)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		hashes := []string{}
+		for _, document := range decodeDocuments(t, stdout) {
+			label := getField(document, "metadata", "labels", generatedByLabel)
+			if label != generatedByValue {
+				t.Errorf("Expected the %s label on the %s", generatedByLabel, document["kind"])
+			}
+
+			annotation := defaultAnnotationPrefix + "/" + configHashAnnotation
+			hash, _ := getField(document, "metadata", "annotations", annotation).(string)
+			hashes = append(hashes, hash)
+		}
+
+		return hashes
+	}
+
+	hashes := getHashes()
+	if len(hashes) != 3 || hashes[0] == "" || hashes[0] != hashes[1] || hashes[0] != hashes[2] {
+		t.Fatalf("Expected the same config hash on the three objects but got %v", hashes)
+	}
+
+	if getHashes("--report", path.Join(dir, "report.json"))[0] != hashes[0] {
+		t.Error("Expected the hash to not depend on the report path")
+	}
+
+	if getHashes("--placement-only")[0] != hashes[0] {
+		t.Error("Expected the placement objects to have the same hash with --placement-only")
+	}
+
+	if getHashes("--remediationAction", "enforce")[0] == hashes[0] {
+		t.Error("Expected the hash to change with the remediation action")
+	}
+
+	informHash := getHashes("--remediationAction", "Inform")[0]
+	auditHash := getHashes("--remediationAction", "audit", "--accept-legacy-actions")[0]
+	if informHash != hashes[0] || auditHash != hashes[0] {
+		t.Error("Expected the hash to use the resolved remediation action")
+	}
+
+	if getHashes("--configuration-policy-name", "my-policy")[0] != hashes[0] {
+		t.Error("Expected the hash to use the resolved ConfigurationPolicy name")
+	}
+
+	if getHashes("--disable-templates=false")[0] == hashes[0] {
+		t.Error("Expected the hash to change when the disable templates annotation is added")
+	}
+
+	os.Setenv("SOURCE_DATE_EPOCH", "1")
+	epochHash := getHashes("--timestamp-annotation")[0]
+	os.Setenv("SOURCE_DATE_EPOCH", "2")
+	if getHashes("--timestamp-annotation")[0] == epochHash {
+		t.Error("Expected the hash to change with SOURCE_DATE_EPOCH")
+	}
+}
+
+func TestRunObjDefGlob(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "configmap1.yaml", testConfigMap)
+	writeTestFile(
+		t, dir, "configmap2.yaml", strings.Replace(testConfigMap, "my-config", "my-config2", 1),
+	)
+	writeTestFile(t, dir, "notes.txt", "not a manifest")
+	err := os.Mkdir(path.Join(dir, "sub"), 0700)
+	if err != nil {
+		t.Fatalf("Failed to create the directory: %v", err)
+	}
+
+	stdout, _, err := runGenerator(
+		t, "--namespace", "my-policies", "--name", "my-policy", path.Join(dir, "*.yaml"),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	policyTemplates := getField(decodeDocuments(t, stdout)[0], "spec", "policy-templates")
+	objectTemplates := getField(
+		policyTemplates.([]interface{})[0].(map[string]interface{}),
+		"objectDefinition",
+		"spec",
+		"object-templates",
+	).([]interface{})
+	names := []interface{}{}
+	for _, objectTemplate := range objectTemplates {
+		names = append(names, getField(objectTemplate.(map[string]interface{}), "metadata", "name"))
+	}
+
+	if !reflect.DeepEqual(names, []interface{}{"my-config", "my-config2"}) {
+		t.Errorf("Got the objects %v; expected my-config and my-config2", names)
+	}
+
+	tests := []struct {
+		name   string
+		glob   string
+		errMsg string
+	}{
+		{"no matches", path.Join(dir, "*.json"), "did not match any files"},
+		{"invalid glob", path.Join(dir, "[.yaml"), "is invalid"},
+		{
+			"directory without a Kustomization file",
+			path.Join(dir, "s*"),
+			"the object manifest directory " + path.Join(dir, "sub") +
+				" must have a kustomization.yaml file",
+		},
+	}
+
+	for _, test := range tests {
+		_, _, err := runGenerator(t, "--namespace", "my-policies", "--name", "my-policy", test.glob)
+		if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+			t.Errorf(
+				`%s: expected an error containing "%s" but got %v`, test.name, test.errMsg, err,
+			)
+		}
+	}
+}
+
+const testPlacementBinding = `apiVersion: policy.open-cluster-management.io/v1
+kind: PlacementBinding
+metadata:
+  name: my-binding
+  namespace: my-policies
+placementRef:
+  name: placement-my-policy
+  kind: PlacementRule
+  apiGroup: apps.open-cluster-management.io
+subjects:
+  - name: my-policy
+    kind: Policy
+    apiGroup: policy.open-cluster-management.io
+`
+
+func TestValidatePlacementBinding(t *testing.T) {
+	tests := []struct {
+		name         string
+		binding      string
+		expectedName string
+		errMsg       string
+	}{
+		{"valid", testPlacementBinding, "my-binding", ""},
+		{
+			"wrong namespace",
+			strings.Replace(testPlacementBinding, "namespace: my-policies", "namespace: other", 1),
+			"",
+			"must be in the policy namespace my-policies",
+		},
+		{
+			"wrong placement rule",
+			strings.Replace(testPlacementBinding, "name: placement-my-policy", "name: other", 1),
+			"",
+			"must reference the placement rule placement-my-policy",
+		},
+		{
+			"missing subject",
+			strings.Replace(testPlacementBinding, "name: my-policy\n", "name: other\n", 1),
+			"",
+			"must have the policy my-policy as a subject",
+		},
+		{"no placement binding", testConfigMap, "", "did not have a placement binding"},
+	}
+
+	for _, test := range tests {
+		bindingPath := writeTestFile(t, t.TempDir(), "binding.yaml", test.binding)
+
+		name, err := validatePlacementBinding(
+			bindingPath, "my-policies", "my-policy", "placement-my-policy",
+		)
+		if test.errMsg == "" {
+			if err != nil || name != test.expectedName {
+				t.Errorf("%s: got %s, %v; expected %s", test.name, name, err, test.expectedName)
+			}
+
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+			t.Errorf(
+				`%s: expected an error containing "%s" but got %v`, test.name, test.errMsg, err,
+			)
+		}
+	}
+}
+
+func TestRunPlacementBinding(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "configmap.yaml", testConfigMap)
+	bindingPath := writeTestFile(t, dir, "binding.yaml", testPlacementBinding)
+
+	stdout, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--placement-binding", bindingPath,
+		manifestPath,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	kinds := []interface{}{}
+	for _, document := range decodeDocuments(t, stdout) {
+		kinds = append(kinds, document["kind"])
+	}
+
+	if !reflect.DeepEqual(kinds, []interface{}{"Policy", "PlacementRule"}) {
+		t.Errorf("Got the kinds %v; expected the placement binding to not be generated", kinds)
+	}
+
+	// The placement binding is validated with the flags so the mismatch is reported before the
+	// invalid patch is used
+	mismatchedBindingPath := writeTestFile(
+		t,
+		dir,
+		"mismatched-binding.yaml",
+		strings.Replace(testPlacementBinding, "name: placement-my-policy", "name: other", 1),
+	)
+	patchPath := writeTestFile(t, dir, "patch.yaml", "kind: Foo\n")
+
+	_, _, err = runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--placement-binding", mismatchedBindingPath,
+		"--patches", patchPath,
+		manifestPath,
+	)
+	errMsg := "the placement binding my-binding must reference the placement rule " +
+		"placement-my-policy"
+	if err == nil || err.Error() != errMsg {
+		t.Errorf(`Expected the error "%s" but got %v`, errMsg, err)
+	}
+}
+
+func TestGetDependencies(t *testing.T) {
+	dependencies := getDependencies(stringList{"my-policies/other", "other-ns/other=NonCompliant"})
+	expected := []map[string]string{
+		{
+			"apiVersion": policyAPIVersion,
+			"kind":       policyKind,
+			"name":       "other",
+			"namespace":  "my-policies",
+			"compliance": "Compliant",
+		},
+		{
+			"apiVersion": policyAPIVersion,
+			"kind":       policyKind,
+			"name":       "other",
+			"namespace":  "other-ns",
+			"compliance": "NonCompliant",
+		},
+	}
+
+	if !reflect.DeepEqual(dependencies, expected) {
+		t.Errorf("Got the dependencies %v; expected %v", dependencies, expected)
+	}
+}
+
+func TestRunDependencies(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	tests := []struct {
+		name     string
+		flag     string
+		expected []interface{}
+		errMsg   string
+	}{
+		{
+			"single dependency",
+			"my-policies/other",
+			[]interface{}{
+				map[string]interface{}{
+					"apiVersion": policyAPIVersion,
+					"kind":       policyKind,
+					"name":       "other",
+					"namespace":  "my-policies",
+					"compliance": "Compliant",
+				},
+			},
+			"",
+		},
+		{
+			"cross-namespace dependency",
+			"other-ns/other=Pending",
+			[]interface{}{
+				map[string]interface{}{
+					"apiVersion": policyAPIVersion,
+					"kind":       policyKind,
+					"name":       "other",
+					"namespace":  "other-ns",
+					"compliance": "Pending",
+				},
+			},
+			"",
+		},
+		{
+			"dependency without a namespace",
+			"other",
+			nil,
+			`the dependency "other" must be in the format of "namespace/name[=complianceState]"`,
+		},
+		{
+			"dependency on itself",
+			"my-policies/my-policy",
+			nil,
+			"the policy my-policy cannot depend on itself",
+		},
+		{
+			"invalid name",
+			"my-policies/Other",
+			nil,
+			`the dependency "my-policies/Other" has an invalid name or namespace "Other"`,
+		},
+		{
+			"invalid compliance state",
+			"my-policies/other=Done",
+			nil,
+			`the compliance state "Done" of the dependency "my-policies/other=Done" must be one of`,
+		},
+	}
+
+	for _, test := range tests {
+		stdout, _, err := runGenerator(
+			t,
+			"--namespace", "my-policies",
+			"--name", "my-policy",
+			"--dependencies", test.flag,
+			manifestPath,
+		)
+		if test.errMsg != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+				t.Errorf(
+					`%s: expected an error containing "%s" but got %v`, test.name, test.errMsg, err,
+				)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+
+		dependencies := getField(decodeDocuments(t, stdout)[0], "spec", "dependencies")
+		if !reflect.DeepEqual(dependencies, test.expected) {
+			t.Errorf(
+				"%s: got the dependencies %v; expected %v", test.name, dependencies, test.expected,
+			)
+		}
+	}
+}
+
+const testHubTemplateConfigMap = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: hub-config
+  namespace: default
+data:
+  cluster: '{{hub .ManagedClusterName hub}}'
+  password: '{{hub fromConfigMap "policies" "settings" "password" | base64enc hub}}'
+  block: |
+    name: {{hub .ManagedClusterName hub}}
+`
+
+func TestRunHubTemplates(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testHubTemplateConfigMap)
+	expectedData := map[string]interface{}{
+		"cluster":  "{{hub .ManagedClusterName hub}}",
+		"password": `{{hub fromConfigMap "policies" "settings" "password" | base64enc hub}}`,
+		"block":    "name: {{hub .ManagedClusterName hub}}\n",
+	}
+
+	for _, indent := range []string{"2", "4"} {
+		stdout, _, err := runGenerator(
+			t,
+			"--namespace", "my-policies",
+			"--name", "my-policy",
+			"--indent", indent,
+			manifestPath,
+		)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		// The templates must not be reformatted, such as by changing the quoting
+		for _, line := range []string{
+			`cluster: '{{hub .ManagedClusterName hub}}'`,
+			`password: '{{hub fromConfigMap "policies" "settings" "password" | base64enc hub}}'`,
+			`name: {{hub .ManagedClusterName hub}}`,
+		} {
+			if !strings.Contains(stdout, line) {
+				t.Errorf("Expected the output with the indent %s to contain %s", indent, line)
+			}
+		}
+
+		policyTemplates := getField(decodeDocuments(t, stdout)[0], "spec", "policy-templates")
+		objectTemplates := getField(
+			policyTemplates.([]interface{})[0].(map[string]interface{}),
+			"objectDefinition",
+			"spec",
+			"object-templates",
+		).([]interface{})
+		data := getField(objectTemplates[0].(map[string]interface{}), "data")
+		if !reflect.DeepEqual(data, expectedData) {
+			t.Errorf("Got the data %v with the indent %s; expected %v", data, indent, expectedData)
+		}
+	}
+
+	stdout, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--object-templates-raw",
+		manifestPath,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	policyTemplates := getField(decodeDocuments(t, stdout)[0], "spec", "policy-templates")
+	raw := getField(
+		policyTemplates.([]interface{})[0].(map[string]interface{}),
+		"objectDefinition",
+		"spec",
+		"object-templates-raw",
+	)
+	if raw != testHubTemplateConfigMap {
+		t.Errorf("Got the object-templates-raw %v; expected the manifest verbatim", raw)
+	}
+}
+
+// generateDocuments runs the generator for the my-policy policy in the
+// my-policies namespace with the input arguments and returns the generated
+// documents. The test fails if the generation fails.
+func generateDocuments(t *testing.T, args ...string) []map[string]interface{} {
+	t.Helper()
+
+	stdout, _, err := runGenerator(
+		t, append([]string{"--namespace", "my-policies", "--name", "my-policy"}, args...)...,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	return decodeDocuments(t, stdout)
+}
+
+// assertErrorContains fails the test if the input error doesn't contain the
+// input message.
+func assertErrorContains(t *testing.T, err error, errMsg string) {
+	t.Helper()
+
+	if err == nil || !strings.Contains(err.Error(), errMsg) {
+		t.Errorf(`Expected an error containing "%s" but got %v`, errMsg, err)
+	}
+}
+
+func TestRunGeneratedNames(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	// The generated placement rule name is the longest at 10 characters more than the policy name
+	maxName := strings.Repeat("a", 253-len("placement-"))
+	documents := generateDocuments(t, "--name", maxName, manifestPath)
+	if len(documents) != 3 {
+		t.Errorf("Expected three documents but got %d", len(documents))
+	}
+
+	tests := []struct {
+		name          string
+		policyName    string
+		invalidName   string
+		extraFlagArgs []string
+	}{
+		{"over-long policy name", strings.Repeat("a", 254), strings.Repeat("a", 254), nil},
+		{
+			"over-long binding name",
+			maxName + "aaa",
+			"binding-" + maxName + "aaa",
+			[]string{"--placement-name-pattern", "p-{{name}}"},
+		},
+		{"over-long placement name", maxName + "a", "placement-" + maxName + "a", nil},
+		{"invalid characters", "My_Policy", "My_Policy", nil},
+		{
+			"invalid ConfigurationPolicy name",
+			"my-policy",
+			"My_Policy",
+			[]string{"--configuration-policy-name", "My_Policy"},
+		},
+	}
+
+	for _, test := range tests {
+		args := []string{"--namespace", "my-policies", "--name", test.policyName, manifestPath}
+		_, _, err := runGenerator(t, append(test.extraFlagArgs, args...)...)
+		assertErrorContains(
+			t, err, `the generated name "`+test.invalidName+`" is not a valid Kubernetes name`,
+		)
+	}
+}
+
+// getConfigPolicy returns the ConfigurationPolicy in the first policy-template
+// of the input policy.
+func getConfigPolicy(policy map[string]interface{}) map[string]interface{} {
+	policyTemplates, _ := getField(policy, "spec", "policy-templates").([]interface{})
+	if len(policyTemplates) == 0 {
+		return nil
+	}
+
+	configPolicy, _ := getField(
+		policyTemplates[0].(map[string]interface{}), "objectDefinition",
+	).(map[string]interface{})
+
+	return configPolicy
+}
+
+func TestRunSeverity(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	configPolicy := getConfigPolicy(generateDocuments(t, manifestPath)[0])
+	if severity := getField(configPolicy, "spec", "severity"); severity != "low" {
+		t.Errorf("Got the default severity %v; expected low", severity)
+	}
+
+	for _, severity := range []string{"low", "medium", "high", "critical"} {
+		configPolicy := getConfigPolicy(
+			generateDocuments(t, "--severity", severity, manifestPath)[0],
+		)
+		if actual := getField(configPolicy, "spec", "severity"); actual != severity {
+			t.Errorf("Got the severity %v; expected %s", actual, severity)
+		}
+	}
+
+	_, _, err := runGenerator(
+		t, "--namespace", "my-policies", "--name", "my-policy", "--severity", "Low", manifestPath,
+	)
+	assertErrorContains(
+		t,
+		err,
+		`the severity "Low" of the policy my-policy must be one of: low, medium, high, critical`,
+	)
+}
+
+func TestGetGenerationTimestamp(t *testing.T) {
+	defer unsetSourceDateEpoch()()
+
+	timestamp, err := getGenerationTimestamp("2021-08-01T12:00:00+02:00")
+	if err != nil || timestamp != "2021-08-01T10:00:00Z" {
+		t.Errorf("Got %s, %v; expected 2021-08-01T10:00:00Z", timestamp, err)
+	}
+
+	if _, err := getGenerationTimestamp("yesterday"); err == nil {
+		t.Error("Expected an error for an invalid timestamp")
+	}
+
+	if _, err := getGenerationTimestamp(""); err == nil {
+		t.Error("Expected an error without a timestamp or SOURCE_DATE_EPOCH")
+	}
+
+	os.Setenv("SOURCE_DATE_EPOCH", "1627812000")
+
+	timestamp, err = getGenerationTimestamp("")
+	if err != nil || timestamp != "2021-08-01T10:00:00Z" {
+		t.Errorf("Got %s, %v; expected 2021-08-01T10:00:00Z", timestamp, err)
+	}
+
+	timestamp, err = getGenerationTimestamp("2021-08-02T00:00:00Z")
+	if err != nil || timestamp != "2021-08-02T00:00:00Z" {
+		t.Errorf("Got %s, %v; expected the --timestamp flag to take precedence", timestamp, err)
+	}
+
+	os.Setenv("SOURCE_DATE_EPOCH", "now")
+
+	if _, err := getGenerationTimestamp(""); err == nil {
+		t.Error("Expected an error for an invalid SOURCE_DATE_EPOCH")
+	}
+}
+
+func TestRunTimestampAnnotation(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+	annotation := defaultAnnotationPrefix + "/" + timestampAnnotation
+
+	policy := generateDocuments(
+		t, "--timestamp-annotation", "--timestamp", "2021-08-01T12:00:00+02:00", manifestPath,
+	)[0]
+	value := getField(policy, "metadata", "annotations", annotation)
+	if value != "2021-08-01T10:00:00Z" {
+		t.Errorf("Got the timestamp annotation %v; expected 2021-08-01T10:00:00Z", value)
+	}
+
+	policy = generateDocuments(t, "--timestamp", "2021-08-01T12:00:00+02:00", manifestPath)[0]
+	if value := getField(policy, "metadata", "annotations", annotation); value != nil {
+		t.Errorf("Expected no timestamp annotation but got %v", value)
+	}
+}
+
+func TestRunNoHeader(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+	args := []string{"--namespace", "my-policies", "--name", "my-policy"}
+
+	stdout, _, err := runGenerator(t, append(args, manifestPath)...)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	header := "#\n# This file is autogenerated by policy-generator\n# To update, run:\n#\n" +
+		"#    policy-generator --namespace my-policies --name my-policy " + manifestPath +
+		"\n#\n---\n"
+	if !strings.HasPrefix(stdout, header) {
+		t.Errorf("Expected the output to start with the header but got:\n%s", stdout)
+	}
+
+	stdout, _, err = runGenerator(t, append(args, "--no-header", manifestPath)...)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !strings.HasPrefix(stdout, "---\napiVersion: policy.open-cluster-management.io/v1\n") {
+		t.Errorf("Expected the output to start with the policy but got:\n%s", stdout)
+	}
+
+	if strings.Contains(stdout, "#") {
+		t.Errorf("Expected no comments in the output but got:\n%s", stdout)
+	}
+}
+
+func TestRunOutputDir(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "configmap.yaml", testConfigMap)
+	outputDir := path.Join(dir, "output", "policies")
+
+	stdout, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--output-dir", outputDir,
+		manifestPath,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if stdout != "" {
+		t.Errorf("Expected no output on stdout but got:\n%s", stdout)
+	}
+
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		t.Fatalf("Failed to read the output directory: %v", err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != "my-policy.yaml" {
+		t.Fatalf("Expected only my-policy.yaml in the output directory but got %v", entries)
+	}
+
+	outputBytes, err := os.ReadFile(path.Join(outputDir, "my-policy.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to read the output file: %v", err)
+	}
+
+	kinds := []interface{}{}
+	for _, document := range decodeDocuments(t, string(outputBytes)) {
+		kinds = append(kinds, document["kind"])
+	}
+
+	if !reflect.DeepEqual(kinds, []interface{}{"Policy", "PlacementRule", "PlacementBinding"}) {
+		t.Errorf("Got the kinds %v; expected the policy and its placement objects", kinds)
+	}
+
+	_, _, err = runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--output-dir", outputDir,
+		"-o", path.Join(dir, "policy.yaml"),
+		manifestPath,
+	)
+	assertErrorContains(t, err, "the --output and --output-dir flags cannot both be set")
+}
+
+func TestCreatePatchFromK8sObjectsRaw(t *testing.T) {
+	options := getTestPolicyOptions()
+	options.raw = true
+	options.recordDiff = "Log"
+	objDefFiles := [][]byte{[]byte(testConfigMap), []byte(testConstraintTemplate)}
+
+	patch, err := createPatchFromK8sObjects(options, &objDefFiles)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	policy := decodeDocuments(t, string(patch))[0]
+	kinds := getPolicyTemplateKinds(policy)
+	if !reflect.DeepEqual(kinds, []string{"ConfigurationPolicy"}) {
+		t.Fatalf("Expected only a ConfigurationPolicy but got %v", kinds)
+	}
+
+	spec := getField(getConfigPolicy(policy), "spec").(map[string]interface{})
+	if spec["object-templates-raw"] != testConfigMap+testConstraintTemplate {
+		t.Errorf("Unexpected object-templates-raw: %v", spec["object-templates-raw"])
+	}
+
+	if spec["recordDiff"] != "Log" {
+		t.Errorf("Expected recordDiff to be Log but got %v", spec["recordDiff"])
+	}
+
+	if _, found := spec["object-templates"]; found {
+		t.Error("Expected object-templates to not be set with object-templates-raw")
+	}
+
+	objDefFiles = [][]byte{[]byte(testConfigMap), []byte("\n")}
+	_, err = createPatchFromK8sObjects(options, &objDefFiles)
+	assertErrorContains(t, err, "object manifest files cannot be empty")
+}
+
+func TestRunPlacementNamePattern(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	documents := generateDocuments(
+		t, "--placement-name-pattern", "{{name}}-placement", manifestPath,
+	)
+	if name := getField(documents[1], "metadata", "name"); name != "my-policy-placement" {
+		t.Errorf("Got the placement rule name %v; expected my-policy-placement", name)
+	}
+
+	if name := getField(documents[2], "placementRef", "name"); name != "my-policy-placement" {
+		t.Errorf("Got the placementRef name %v; expected my-policy-placement", name)
+	}
+
+	_, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--placement-name-pattern", "placement",
+		manifestPath,
+	)
+	assertErrorContains(t, err, `the placement name pattern "placement" must contain {{name}}`)
+}
+
+const testIamPolicy = `apiVersion: policy.open-cluster-management.io/v1
+kind: IamPolicy
+metadata:
+  name: my-iam-policy
+spec:
+  maxClusterRoleBindingUsers: 5
+`
+
+func TestRunIamPolicy(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "iampolicy.yaml", testIamPolicy)
+
+	policy := generateDocuments(t, manifestPath)[0]
+	if kinds := getPolicyTemplateKinds(policy); !reflect.DeepEqual(kinds, []string{"IamPolicy"}) {
+		t.Errorf("Expected only the IamPolicy policy-template but got %v", kinds)
+	}
+
+	for _, maxUsers := range []string{"-1", `"5"`} {
+		invalidPath := writeTestFile(
+			t, dir, "invalid.yaml", strings.Replace(testIamPolicy, ": 5", ": "+maxUsers, 1),
+		)
+		_, _, err := runGenerator(
+			t, "--namespace", "my-policies", "--name", "my-policy", invalidPath,
+		)
+		assertErrorContains(
+			t,
+			err,
+			"the IamPolicy my-iam-policy must have spec.maxClusterRoleBindingUsers set to a "+
+				"non-negative integer",
+		)
+	}
+
+	missingPath := writeTestFile(
+		t,
+		dir,
+		"missing.yaml",
+		strings.Replace(testIamPolicy, "spec:\n  maxClusterRoleBindingUsers: 5\n", "spec: {}\n", 1),
+	)
+	_, _, err := runGenerator(t, "--namespace", "my-policies", "--name", "my-policy", missingPath)
+	assertErrorContains(t, err, "must have spec.maxClusterRoleBindingUsers set")
+}
+
+const testCertPolicy = `apiVersion: policy.open-cluster-management.io/v1
+kind: CertificatePolicy
+metadata:
+  name: my-cert-policy
+spec:
+  minimumDuration: 300h
+  minimumCADuration: 700h
+  namespaceSelector:
+    include:
+      - default
+`
+
+func TestRunCertificatePolicy(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "certpolicy.yaml", testCertPolicy)
+
+	policy := generateDocuments(t, manifestPath)[0]
+	kinds := getPolicyTemplateKinds(policy)
+	if !reflect.DeepEqual(kinds, []string{"CertificatePolicy"}) {
+		t.Errorf("Expected only the CertificatePolicy policy-template but got %v", kinds)
+	}
+
+	certPolicy := getConfigPolicy(policy)
+	if duration := getField(certPolicy, "spec", "minimumDuration"); duration != "300h" {
+		t.Errorf(`Expected the minimumDuration "300h" but got %v`, duration)
+	}
+
+	include := getField(certPolicy, "spec", "namespaceSelector", "include")
+	if !reflect.DeepEqual(include, []interface{}{"default"}) {
+		t.Errorf("Expected the namespaceSelector to include default but got %v", include)
+	}
+
+	tests := []struct {
+		name     string
+		original string
+		invalid  string
+		errMsg   string
+	}{
+		{
+			"invalid minimumDuration",
+			"minimumDuration: 300h",
+			"minimumDuration: 300 hours",
+			`has an invalid spec.minimumDuration of "300 hours"`,
+		},
+		{
+			"invalid minimumCADuration",
+			"minimumCADuration: 700h",
+			"minimumCADuration: 1y",
+			`has an invalid spec.minimumCADuration of "1y"`,
+		},
+		{
+			"non-string minimumDuration",
+			"minimumDuration: 300h",
+			"minimumDuration: 300",
+			"must have spec.minimumDuration as a string",
+		},
+	}
+
+	for _, test := range tests {
+		invalidPath := writeTestFile(
+			t, dir, "invalid.yaml", strings.Replace(testCertPolicy, test.original, test.invalid, 1),
+		)
+		_, _, err := runGenerator(
+			t, "--namespace", "my-policies", "--name", "my-policy", invalidPath,
+		)
+		assertErrorContains(t, err, "the CertificatePolicy my-cert-policy "+test.errMsg)
+	}
+}
+
+func TestRunClusterSelectorValues(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	documents := generateDocuments(
+		t,
+		"--cluster-selectors", "environment=dev,cloud=aws,environment=staging",
+		manifestPath,
+	)
+	matchExpressions := getField(documents[1], "spec", "clusterSelector", "matchExpressions")
+	expected := []interface{}{
+		map[string]interface{}{"key": "cloud", "operator": "In", "values": []interface{}{"aws"}},
+		map[string]interface{}{
+			"key":      "environment",
+			"operator": "In",
+			"values":   []interface{}{"dev", "staging"},
+		},
+	}
+	if !reflect.DeepEqual(matchExpressions, expected) {
+		t.Errorf("Expected the match expressions %v but got %v", expected, matchExpressions)
+	}
+}
+
+func TestParseClusterSelector(t *testing.T) {
+	tests := []struct {
+		clusterSelector string
+		label           string
+		operator        string
+		value           string
+		ok              bool
+	}{
+		{"env=prod", "env", "In", "prod", true},
+		{"env!=prod", "env", "NotIn", "prod", true},
+		{"env", "env", "Exists", "", true},
+		{"!env", "env", "DoesNotExist", "", true},
+		{"!env=prod", "", "", "", false},
+		{"=prod", "", "", "", false},
+		{"", "", "", "", false},
+	}
+
+	for _, test := range tests {
+		label, operator, value, ok := parseClusterSelector(test.clusterSelector)
+		if label != test.label || operator != test.operator || value != test.value ||
+			ok != test.ok {
+			t.Errorf(
+				`parseClusterSelector("%s") = %s, %s, %s, %v; expected %s, %s, %s, %v`,
+				test.clusterSelector,
+				label,
+				operator,
+				value,
+				ok,
+				test.label,
+				test.operator,
+				test.value,
+				test.ok,
+			)
+		}
+	}
+}
+
+func TestRunClusterSelectorOperators(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	documents := generateDocuments(
+		t, "--cluster-selectors", "vendor!=IBM,vendor!=Other,!local-cluster,gpu", manifestPath,
+	)
+	matchExpressions := getField(documents[1], "spec", "clusterSelector", "matchExpressions")
+	expected := []interface{}{
+		map[string]interface{}{"key": "gpu", "operator": "Exists"},
+		map[string]interface{}{"key": "local-cluster", "operator": "DoesNotExist"},
+		map[string]interface{}{
+			"key":      "vendor",
+			"operator": "NotIn",
+			"values":   []interface{}{"IBM", "Other"},
+		},
+	}
+	if !reflect.DeepEqual(matchExpressions, expected) {
+		t.Errorf("Expected the match expressions %v but got %v", expected, matchExpressions)
+	}
+
+	_, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--cluster-selectors", "!gpu=true",
+		manifestPath,
+	)
+	assertErrorContains(t, err, `the clusterSelector "!gpu=true"`)
+}
+
+// getObjectNamespaces returns the namespaces of the object-templates of the
+// ConfigurationPolicy in the input policy in order.
+func getObjectNamespaces(policy map[string]interface{}) []interface{} {
+	namespaces := []interface{}{}
+	objectTemplates, _ := getField(
+		getConfigPolicy(policy), "spec", "object-templates",
+	).([]interface{})
+	for _, objectTemplate := range objectTemplates {
+		namespaces = append(
+			namespaces, getField(objectTemplate.(map[string]interface{}), "metadata", "namespace"),
+		)
+	}
+
+	return namespaces
+}
+
+func TestRunInjectNamespace(t *testing.T) {
+	manifestPath := writeTestFile(
+		t,
+		t.TempDir(),
+		"manifests.yaml",
+		testConfigMap+"---\n"+
+			strings.Replace(
+				testConfigMap, "name: my-config", "name: other\n  namespace: default", 1,
+			)+
+			"---\napiVersion: rbac.authorization.k8s.io/v1\nkind: ClusterRole\nmetadata:\n"+
+			"  name: my-role\n",
+	)
+
+	tests := []struct {
+		name       string
+		args       []string
+		namespaces []interface{}
+	}{
+		{"without the flag", []string{manifestPath}, []interface{}{nil, "default", nil}},
+		{
+			"with the flag",
+			[]string{"--inject-namespace", manifestPath},
+			[]interface{}{"my-policies", "default", nil},
+		},
+	}
+
+	for _, test := range tests {
+		namespaces := getObjectNamespaces(generateDocuments(t, test.args...)[0])
+		if !reflect.DeepEqual(namespaces, test.namespaces) {
+			t.Errorf(
+				"%s: expected the namespaces %v but got %v", test.name, test.namespaces, namespaces,
+			)
+		}
+	}
+}
+
+func TestRunPolicyManifest(t *testing.T) {
+	manifestPath := writeTestFile(
+		t,
+		t.TempDir(),
+		"policy.yaml",
+		"apiVersion: policy.open-cluster-management.io/v1\nkind: Policy\nmetadata:\n"+
+			"  name: my-wrapped-policy\n",
+	)
+
+	_, _, err := runGenerator(t, "--namespace", "my-policies", "--name", "my-policy", manifestPath)
+	assertErrorContains(
+		t,
+		err,
+		"the object manifest my-wrapped-policy is a Policy which can't be wrapped in another "+
+			"policy",
+	)
+}
+
+func TestRunClusterConditions(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	tests := []struct {
+		name       string
+		args       []string
+		conditions []interface{}
+	}{
+		{
+			"default",
+			[]string{manifestPath},
+			[]interface{}{
+				map[string]interface{}{
+					"status": "True", "type": "ManagedClusterConditionAvailable",
+				},
+			},
+		},
+		{"empty", []string{"--cluster-conditions", "", manifestPath}, []interface{}{}},
+		{
+			"custom",
+			[]string{"--cluster-conditions", "HubAcceptedManagedCluster=Unknown", manifestPath},
+			[]interface{}{
+				map[string]interface{}{"status": "Unknown", "type": "HubAcceptedManagedCluster"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		documents := generateDocuments(t, test.args...)
+		conditions := getField(documents[1], "spec", "clusterConditions")
+		if !reflect.DeepEqual(conditions, test.conditions) {
+			t.Errorf(
+				"%s: expected the cluster conditions %v but got %v",
+				test.name,
+				test.conditions,
+				conditions,
+			)
+		}
+	}
+
+	_, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--cluster-conditions", "ManagedClusterConditionAvailable=Yes",
+		manifestPath,
+	)
+	assertErrorContains(
+		t,
+		err,
+		`the cluster condition "ManagedClusterConditionAvailable=Yes" must be in the format of `+
+			`"type=status"`,
+	)
+}
+
+func TestRunVersion(t *testing.T) {
+	stdout, _, err := runGenerator(t, "--version")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := "policy-generator version unknown\nGo version: " + runtime.Version() +
+		"\nBuild date: unknown\n"
+	if stdout != expected {
+		t.Errorf(`Expected the version information "%s" but got "%s"`, expected, stdout)
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "configmap.yaml", testConfigMap)
+	reportPath := path.Join(dir, "report.json")
+
+	stdout, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--report", reportPath,
+		manifestPath,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(decodeDocuments(t, stdout)) != 3 {
+		t.Error("Expected the report to not replace the generated YAML on stdout")
+	}
+
+	reportBytes, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("Failed to read the report: %v", err)
+	}
+
+	var report map[string][]policyReport
+	err = json.Unmarshal(reportBytes, &report)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal the report: %v", err)
+	}
+
+	expected := map[string][]policyReport{
+		"policies": {
+			{
+				Name:             "my-policy",
+				Namespace:        "my-policies",
+				Placement:        "placement-my-policy",
+				PlacementBinding: "binding-my-policy",
+			},
+		},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Expected the report %v but got %v", expected, report)
+	}
+}
+
+func TestRunLegacyRemediationActions(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	tests := []struct {
+		remAction string
+		expected  string
+	}{
+		{"audit", "inform"},
+		{"Remediate", "enforce"},
+		{"Enforce", "enforce"},
+	}
+
+	for _, test := range tests {
+		policy := generateDocuments(
+			t, "--accept-legacy-actions", "--remediationAction", test.remAction, manifestPath,
+		)[0]
+		remActions := []interface{}{
+			getField(policy, "spec", "remediationAction"),
+			getField(getConfigPolicy(policy), "spec", "remediationAction"),
+		}
+		if !reflect.DeepEqual(remActions, []interface{}{test.expected, test.expected}) {
+			t.Errorf(
+				"Expected the remediation action %s for %s but got %v",
+				test.expected,
+				test.remAction,
+				remActions,
+			)
+		}
+	}
+
+	for _, remAction := range []string{"audit", "remediate"} {
+		_, _, err := runGenerator(
+			t,
+			"--namespace", "my-policies",
+			"--name", "my-policy",
+			"--remediationAction", remAction,
+			manifestPath,
+		)
+		assertErrorContains(
+			t,
+			err,
+			`the remediation action "`+remAction+`" of the policy my-policy must be inform or `+
+				`enforce`,
+		)
+	}
+}
+
+func TestRunCreateNamespace(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	documents := generateDocuments(t, "--create-namespace", manifestPath)
+	kinds := []interface{}{}
+	for _, document := range documents {
+		kinds = append(kinds, document["kind"])
+	}
+
+	expected := []interface{}{"Namespace", "Policy", "PlacementRule", "PlacementBinding"}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Fatalf("Expected the kinds %v but got %v", expected, kinds)
+	}
+
+	if name := getField(documents[0], "metadata", "name"); name != "my-policies" {
+		t.Errorf("Expected the namespace my-policies but got %v", name)
+	}
+
+	if documents := generateDocuments(t, manifestPath); documents[0]["kind"] != "Policy" {
+		t.Errorf("Expected no namespace by default but got %v", documents[0]["kind"])
+	}
+}
+
+func TestRunConfigurationPolicyName(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{manifestPath}, "my-policy"},
+		{
+			[]string{"--configuration-policy-name", "my-config-policy", manifestPath},
+			"my-config-policy",
+		},
+	}
+
+	for _, test := range tests {
+		configPolicy := getConfigPolicy(generateDocuments(t, test.args...)[0])
+		if name := getField(configPolicy, "metadata", "name"); name != test.expected {
+			t.Errorf("Expected the ConfigurationPolicy name %s but got %v", test.expected, name)
+		}
+	}
+}
+
+func TestRunDuplicateObjects(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "configmap.yaml", testConfigMap)
+	otherPath := writeTestFile(
+		t, dir, "other.yaml", strings.Replace(testConfigMap, "value", "other-value", 1),
+	)
+
+	_, _, err := runGenerator(
+		t, "--namespace", "my-policies", "--name", "my-policy", manifestPath, otherPath,
+	)
+	assertErrorContains(
+		t, err, "the object manifests contain the ConfigMap my-config object more than once",
+	)
+
+	namespacedPath := writeTestFile(
+		t,
+		dir,
+		"namespaced.yaml",
+		strings.Replace(
+			testConfigMap, "name: my-config", "name: my-config\n  namespace: default", 1,
+		),
+	)
+	documents := generateDocuments(t, manifestPath, namespacedPath)
+	objectTemplates, _ := getField(
+		getConfigPolicy(documents[0]), "spec", "object-templates",
+	).([]interface{})
+	if len(objectTemplates) != 2 {
+		t.Errorf(
+			"Expected objects in different namespaces to be unique but got %v", objectTemplates,
+		)
+	}
+}
+
+func TestRunIndent(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	outputs := map[string]string{}
+	for _, indent := range []string{"2", "4"} {
+		stdout, _, err := runGenerator(
+			t,
+			"--namespace", "my-policies",
+			"--name", "my-policy",
+			"--indent", indent,
+			manifestPath,
+		)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		outputs[indent] = stdout
+	}
+
+	for indent, expected := range map[string]string{
+		"2": "\nspec:\n  disabled: true\n",
+		"4": "\nspec:\n    disabled: true\n",
+	} {
+		if !strings.Contains(outputs[indent], expected) {
+			t.Errorf("Expected the output with --indent %s to contain %q", indent, expected)
+		}
+	}
+
+	// Each document must use the indentation, not just the policy
+	if strings.Count(outputs["4"], "\nmetadata:\n    ") != 3 {
+		t.Errorf("Expected each document to be indented with four spaces:\n%s", outputs["4"])
+	}
+
+	if !reflect.DeepEqual(decodeDocuments(t, outputs["2"]), decodeDocuments(t, outputs["4"])) {
+		t.Error("Expected the indentation to not change the generated objects")
+	}
+
+	for _, indent := range []string{"1", "10"} {
+		_, _, err := runGenerator(
+			t,
+			"--namespace", "my-policies",
+			"--name", "my-policy",
+			"--indent", indent,
+			manifestPath,
+		)
+		assertErrorContains(t, err, "the --indent flag must be between 2 and 9")
+	}
+}
+
+func TestEncodeYAMLDocuments(t *testing.T) {
+	documents := []interface{}{
+		map[string]interface{}{"kind": "Policy"},
+		map[string]interface{}{"kind": "PlacementRule"},
+		map[string]interface{}{"kind": "PlacementBinding"},
+	}
+
+	yamlBytes, err := encodeYAMLDocuments(documents, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := "kind: Policy\n---\nkind: PlacementRule\n---\nkind: PlacementBinding\n"
+	if string(yamlBytes) != expected {
+		t.Errorf(`Expected the YAML "%s" but got "%s"`, expected, yamlBytes)
+	}
+}
+
+func TestRunDocumentSeparators(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	for _, args := range [][]string{{manifestPath}, {"--no-header", manifestPath}} {
+		stdout, _, err := runGenerator(
+			t, append([]string{"--namespace", "my-policies", "--name", "my-policy"}, args...)...,
+		)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		// Each of the three documents is preceded by exactly one separator
+		separators := strings.Count("\n"+stdout, "\n---\n")
+		if separators != 3 || strings.Contains(stdout, "---\n---") {
+			t.Errorf("Expected exactly one separator per document:\n%s", stdout)
+		}
+	}
+}
+
+func TestRunDisableTemplates(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	tests := []struct {
+		args     []string
+		expected interface{}
+	}{
+		{[]string{manifestPath}, nil},
+		{[]string{"--disable-templates", manifestPath}, "true"},
+		{[]string{"--disable-templates=false", manifestPath}, "false"},
+	}
+
+	for _, test := range tests {
+		policy := generateDocuments(t, test.args...)[0]
+		annotations, _ := getField(policy, "metadata", "annotations").(map[string]interface{})
+		annotation := annotations["policy.open-cluster-management.io/disable-templates"]
+		if annotation != test.expected {
+			t.Errorf(
+				"%v: expected the disable-templates annotation %v but got %v",
+				test.args,
+				test.expected,
+				annotation,
+			)
+		}
+	}
+
+	_, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--disable-templates=yes",
+		manifestPath,
+	)
+	assertErrorContains(t, err, `invalid argument "yes" for "--disable-templates" flag`)
+}
+
+func TestRunMaxPolicyBytes(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	policyYAML, err := encodeYAMLDocuments(
+		[]interface{}{generateDocuments(t, manifestPath)[0]}, 2,
+	)
+	if err != nil {
+		t.Fatalf("Failed to encode the policy: %v", err)
+	}
+
+	policySize := len(policyYAML)
+	generateDocuments(t, "--max-policy-bytes", strconv.Itoa(policySize), manifestPath)
+
+	tests := []struct {
+		args   []string
+		errMsg string
+	}{
+		{
+			[]string{"--max-policy-bytes", strconv.Itoa(policySize - 1)},
+			"the policy my-policy is " + strconv.Itoa(policySize) + " bytes which exceeds the " +
+				"--max-policy-bytes limit of " + strconv.Itoa(policySize-1) + " bytes",
+		},
+		{
+			// The policy is measured with the output indentation
+			[]string{"--max-policy-bytes", strconv.Itoa(policySize), "--indent", "4"},
+			"exceeds the --max-policy-bytes limit",
+		},
+		{
+			[]string{"--max-policy-bytes", "-1"},
+			"the --max-policy-bytes flag must not be negative",
+		},
+	}
+
+	for _, test := range tests {
+		args := append([]string{"--namespace", "my-policies", "--name", "my-policy"}, test.args...)
+		_, _, err := runGenerator(t, append(args, manifestPath)...)
+		assertErrorContains(t, err, test.errMsg)
+	}
+}
+
+func TestRunKustomizeDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "configmap.yaml", testConfigMap)
+	writeTestFile(
+		t,
+		dir,
+		"kustomization.yaml",
+		"resources:\n  - configmap.yaml\nnamespace: my-app\ncommonLabels:\n  app: my-app\n",
+	)
+
+	policy := generateDocuments(t, dir)[0]
+	objectTemplates, _ := getField(
+		getConfigPolicy(policy), "spec", "object-templates",
+	).([]interface{})
+	if len(objectTemplates) != 1 {
+		t.Fatalf("Expected one object-template but got %v", objectTemplates)
+	}
+
+	configMap := objectTemplates[0].(map[string]interface{})
+	if namespace := getField(configMap, "metadata", "namespace"); namespace != "my-app" {
+		t.Errorf("Expected the Kustomize namespace my-app but got %v", namespace)
+	}
+
+	if label := getField(configMap, "metadata", "labels", "app"); label != "my-app" {
+		t.Errorf("Expected the Kustomize label my-app but got %v", label)
+	}
+
+	_, _, err := runGenerator(
+		t, "--namespace", "my-policies", "--name", "my-policy", t.TempDir(),
+	)
+	assertErrorContains(t, err, "must have a kustomization.yaml file")
+}
+
+const testPlacementRule = `apiVersion: apps.open-cluster-management.io/v1
+kind: PlacementRule
+metadata:
+  name: my-placement
+  namespace: my-policies
+spec:
+  clusterSelector:
+    matchExpressions: []
+`
+
+func TestRunPlacementFile(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "configmap.yaml", testConfigMap)
+	placementPath := writeTestFile(t, dir, "placement.yaml", testPlacementRule)
+
+	documents := generateDocuments(t, "--placement", placementPath, manifestPath)
+	if len(documents) != 2 || documents[1]["kind"] != "PlacementBinding" {
+		t.Fatalf("Expected only the policy and placement binding but got %v", documents)
+	}
+
+	if name := getField(documents[1], "placementRef", "name"); name != "my-placement" {
+		t.Errorf("Expected the placement binding to reference my-placement but got %v", name)
+	}
+
+	tests := []struct {
+		name      string
+		placement string
+		errMsg    string
+	}{
+		{"malformed YAML", "kind: [PlacementRule\n", "is invalid YAML"},
+		{
+			"missing name",
+			strings.Replace(testPlacementRule, "  name: my-placement\n", "", 1),
+			"must have a name set",
+		},
+		{"no placement rule", testConfigMap, "did not have a placement rule"},
+	}
+
+	// The invalid patch is only used after the flags are validated, so the placement error is
+	// reported first
+	patchPath := writeTestFile(t, dir, "patch.yaml", "kind: Foo\n")
+	for _, test := range tests {
+		invalidPath := writeTestFile(t, dir, "invalid.yaml", test.placement)
+		_, _, err := runGenerator(
+			t,
+			"--namespace", "my-policies",
+			"--name", "my-policy",
+			"--placement", invalidPath,
+			"--patches", patchPath,
+			manifestPath,
+		)
+		assertErrorContains(t, err, "the placement path "+invalidPath+" "+test.errMsg)
+	}
+
+	missingPath := path.Join(dir, "missing.yaml")
+	_, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--placement", missingPath,
+		manifestPath,
+	)
+	assertErrorContains(t, err, "the placement "+missingPath+" could not be read")
+}
+
+func TestRunPlacementRuleName(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "configmap.yaml", testConfigMap)
+	placementPath := writeTestFile(
+		t,
+		dir,
+		"placements.yaml",
+		testPlacementRule+"---\n"+
+			strings.Replace(testPlacementRule, "name: my-placement", "name: other-placement", 1),
+	)
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"--placement", placementPath}, "my-placement"},
+		{
+			[]string{"--placement", placementPath, "--placement-rule-name", "other-placement"},
+			"other-placement",
+		},
+	}
+
+	for _, test := range tests {
+		documents := generateDocuments(t, append(test.args, manifestPath)...)
+		if name := getField(documents[1], "placementRef", "name"); name != test.expected {
+			t.Errorf("Expected the placement rule %s but got %v", test.expected, name)
+		}
+	}
+
+	_, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--placement", placementPath,
+		"--placement-rule-name", "missing",
+		manifestPath,
+	)
+	assertErrorContains(
+		t, err, "the placement path "+placementPath+" did not have the placement rule missing",
+	)
+
+	_, _, err = runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--placement-rule-name", "my-placement",
+		manifestPath,
+	)
+	assertErrorContains(
+		t, err, "the --placement-rule-name flag can only be set with the --placement flag",
+	)
+}
+
+func TestRunVerbose(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	tests := []struct {
+		verboseArgs []string
+		expected    string
+	}{
+		{nil, ""},
+		{
+			[]string{"-v"},
+			"Generating the policy my-policy in the namespace my-policies\n" +
+				"Generating the placement rule placement-my-policy\n" +
+				"Generating the placement binding binding-my-policy\n",
+		},
+		{
+			[]string{"-vv"},
+			"Read the object manifest " + manifestPath + "\n" +
+				"Generating the policy my-policy in the namespace my-policies\n" +
+				"Generating the placement rule placement-my-policy\n" +
+				"Generating the placement binding binding-my-policy\n",
+		},
+	}
+
+	for _, test := range tests {
+		args := append(test.verboseArgs, "--namespace", "my-policies", "--name", "my-policy")
+		stdout, stderr, err := runGenerator(t, append(args, manifestPath)...)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if stderr != test.expected {
+			t.Errorf(
+				`%v: expected the stderr "%s" but got "%s"`,
+				test.verboseArgs,
+				test.expected,
+				stderr,
+			)
+		}
+
+		// Stdout is reserved for the generated YAML
+		if len(decodeDocuments(t, stdout)) != 3 {
+			t.Errorf(
+				"%v: expected only the generated YAML on stdout but got:\n%s",
+				test.verboseArgs,
+				stdout,
+			)
+		}
+	}
+}
+
+const testExportedConfigMap = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: my-config
+  namespace: default
+  creationTimestamp: "2021-06-01T00:00:00Z"
+  resourceVersion: "12345"
+  uid: 0b1c2d3e-4f5a-6b7c-8d9e-0f1a2b3c4d5e
+  managedFields:
+    - manager: kubectl
+      operation: Apply
+data:
+  key: value
+status:
+  phase: Active
+`
+
+func TestRunSanitizeManifests(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testExportedConfigMap)
+
+	objectTemplates, _ := getField(
+		getConfigPolicy(generateDocuments(t, "--sanitize-manifests", manifestPath)[0]),
+		"spec",
+		"object-templates",
+	).([]interface{})
+	expected := []interface{}{
+		map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "my-config", "namespace": "default"},
+			"data":       map[string]interface{}{"key": "value"},
+		},
+	}
+	if !reflect.DeepEqual(objectTemplates, expected) {
+		t.Errorf("Expected the sanitized objects %v but got %v", expected, objectTemplates)
+	}
+
+	// The object manifests are used as is by default
+	objectTemplates, _ = getField(
+		getConfigPolicy(generateDocuments(t, manifestPath)[0]), "spec", "object-templates",
+	).([]interface{})
+	configMap := objectTemplates[0].(map[string]interface{})
+	keptFields := [][]string{{"status"}, {"metadata", "managedFields"}, {"metadata", "uid"}}
+	for _, fields := range keptFields {
+		if getField(configMap, fields...) == nil {
+			t.Errorf("Expected the %v field to be kept by default", fields)
+		}
+	}
+}
+
+func TestRunPlacementOnly(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	for _, args := range [][]string{{"--placement-only"}, {"--placement-only", manifestPath}} {
+		kinds := []interface{}{}
+		for _, document := range generateDocuments(t, args...) {
+			kinds = append(kinds, document["kind"])
+		}
+
+		if !reflect.DeepEqual(kinds, []interface{}{"PlacementRule", "PlacementBinding"}) {
+			t.Errorf("%v: expected only the placement objects but got %v", args, kinds)
+		}
+	}
+}
+
+func TestRunInheritAnnotations(t *testing.T) {
+	manifestPath := writeTestFile(
+		t,
+		t.TempDir(),
+		"configmap.yaml",
+		strings.Replace(
+			testConfigMap,
+			"name: my-config\n",
+			"name: my-config\n  annotations:\n"+
+				"    policy.open-cluster-management.io/standards: NIST SP 800-171\n"+
+				"    example.com/owner: my-team\n",
+			1,
+		),
+	)
+
+	policy := generateDocuments(
+		t,
+		"--inherit-annotations",
+		"policy.open-cluster-management.io/standards,example.com/missing",
+		manifestPath,
+	)[0]
+	annotations, _ := getField(policy, "metadata", "annotations").(map[string]interface{})
+	expected := map[string]interface{}{
+		"policy.open-cluster-management.io/categories": "CM Configuration Management",
+		"policy.open-cluster-management.io/controls":   "CM-2 Baseline Configuration",
+		"policy.open-cluster-management.io/standards":  "NIST SP 800-171",
+	}
+	if !reflect.DeepEqual(annotations, expected) {
+		t.Errorf("Expected the annotations %v but got %v", expected, annotations)
+	}
+
+	_, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--inherit-annotations", "example.com/in valid",
+		manifestPath,
+	)
+	assertErrorContains(
+		t, err, `the annotation "example.com/in valid" to inherit is not a valid annotation key`,
+	)
+}
+
+func TestRunRequireSelectors(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "configmap.yaml", testConfigMap)
+	placementPath := writeTestFile(t, dir, "placement.yaml", testPlacementRule)
+
+	_, _, err := runGenerator(
+		t, "--namespace", "my-policies", "--name", "my-policy", "--require-selectors", manifestPath,
+	)
+	assertErrorContains(
+		t,
+		err,
+		"the --cluster-selectors or --placement flag must be set when --require-selectors is set",
+	)
+
+	// The guard is off by default and is satisfied by cluster selectors or a placement file
+	for _, args := range [][]string{
+		{manifestPath},
+		{"--require-selectors", "--cluster-selectors", "env=prod", manifestPath},
+		{"--require-selectors", "--placement", placementPath, manifestPath},
+	} {
+		generateDocuments(t, args...)
+	}
+}
+
+const testOperatorPolicy = `apiVersion: policy.open-cluster-management.io/v1beta1
+kind: OperatorPolicy
+metadata:
+  name: my-operator-policy
+spec:
+  subscription:
+    name: my-operator
+    channel: stable
+    source: redhat-operators
+    installPlanApproval: Manual
+`
+
+func TestRunOperatorPolicy(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "operatorpolicy.yaml", testOperatorPolicy)
+
+	policy := generateDocuments(t, manifestPath)[0]
+	kinds := getPolicyTemplateKinds(policy)
+	if !reflect.DeepEqual(kinds, []string{"OperatorPolicy"}) {
+		t.Errorf("Expected only the OperatorPolicy policy-template but got %v", kinds)
+	}
+
+	subscription := getField(getConfigPolicy(policy), "spec", "subscription")
+	expected := map[string]interface{}{
+		"name":                "my-operator",
+		"channel":             "stable",
+		"source":              "redhat-operators",
+		"installPlanApproval": "Manual",
+	}
+	if !reflect.DeepEqual(subscription, expected) {
+		t.Errorf("Expected the subscription %v but got %v", expected, subscription)
+	}
+
+	tests := []struct {
+		name     string
+		original string
+		invalid  string
+		errMsg   string
+	}{
+		{
+			"missing channel",
+			"    channel: stable\n",
+			"",
+			"must have spec.subscription.channel set",
+		},
+		{
+			"invalid installPlanApproval",
+			"installPlanApproval: Manual",
+			"installPlanApproval: Sometimes",
+			`has an invalid spec.subscription.installPlanApproval of "Sometimes"`,
+		},
+	}
+
+	for _, test := range tests {
+		invalidPath := writeTestFile(
+			t,
+			dir,
+			"invalid.yaml",
+			strings.Replace(testOperatorPolicy, test.original, test.invalid, 1),
+		)
+		_, _, err := runGenerator(
+			t, "--namespace", "my-policies", "--name", "my-policy", invalidPath,
+		)
+		assertErrorContains(t, err, "the OperatorPolicy my-operator-policy "+test.errMsg)
+	}
+}
+
+func TestRunCopyPolicyMetadata(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	tests := []struct {
+		args     []string
+		expected interface{}
+	}{
+		{[]string{manifestPath}, nil},
+		{[]string{"--copy-policy-metadata", manifestPath}, true},
+		{[]string{"--copy-policy-metadata=false", manifestPath}, false},
+	}
+
+	for _, test := range tests {
+		configPolicy := getConfigPolicy(generateDocuments(t, test.args...)[0])
+		spec, _ := getField(configPolicy, "spec").(map[string]interface{})
+		copyPolicyMetadata, found := spec["copyPolicyMetadata"]
+		if found != (test.expected != nil) || copyPolicyMetadata != test.expected {
+			t.Errorf(
+				"%v: expected spec.copyPolicyMetadata %v but got %v",
+				test.args,
+				test.expected,
+				copyPolicyMetadata,
+			)
+		}
+	}
+}
+
+func TestRunDuplicateKeys(t *testing.T) {
+	manifestPath := writeTestFile(
+		t,
+		t.TempDir(),
+		"configmap.yaml",
+		strings.Replace(testConfigMap, "name: my-config\n", "name: my-config\n  name: other\n", 1),
+	)
+
+	_, _, err := runGenerator(t, "--namespace", "my-policies", "--name", "my-policy", manifestPath)
+	assertErrorContains(t, err, "the object manifest "+manifestPath+" is invalid")
+	assertErrorContains(t, err, `line 5: mapping key "name" already defined at line 4`)
+}
+
+func TestObjectIdentityAndDedup(t *testing.T) {
+	coreConfigMap := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "a", "namespace": "default"},
+	}
+	customConfigMap := map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "a", "namespace": "default"},
+	}
+
+	identities := []string{getObjectIdentity(coreConfigMap), getObjectIdentity(customConfigMap)}
+	expected := []string{"ConfigMap default/a", "ConfigMap.example.com default/a"}
+	if !reflect.DeepEqual(identities, expected) {
+		t.Errorf("Expected the identities %v but got %v", expected, identities)
+	}
+
+	objDefs := []interface{}{coreConfigMap, customConfigMap, coreConfigMap}
+	deduped := dedupObjects(objDefs)
+	if !reflect.DeepEqual(deduped, []interface{}{coreConfigMap, customConfigMap}) {
+		t.Errorf("Unexpected deduped objects: %v", deduped)
+	}
+
+	if err := assertUniqueObjects(deduped); err != nil {
+		t.Errorf("Expected objects in different API groups to be unique but got: %v", err)
+	}
+
+	if err := assertUniqueObjects(objDefs); err == nil {
+		t.Error("Expected an error for the duplicate object")
+	}
+}
+
+func TestRunDedupManifests(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "configmap.yaml", testConfigMap)
+	writeTestFile(t, dir, "kustomization.yaml", "resources:\n  - configmap.yaml\n")
+	otherPath := writeTestFile(
+		t, dir, "other.yaml", strings.Replace(testConfigMap, "value", "other-value", 1),
+	)
+
+	// The directory renders the same ConfigMap as the file, so only the first occurrence is kept
+	objectTemplates, _ := getField(
+		getConfigPolicy(generateDocuments(t, "--dedup-manifests", manifestPath, dir, otherPath)[0]),
+		"spec",
+		"object-templates",
+	).([]interface{})
+	if len(objectTemplates) != 1 {
+		t.Fatalf("Expected one object-template but got %v", objectTemplates)
+	}
+
+	data := getField(objectTemplates[0].(map[string]interface{}), "data", "key")
+	if data != "value" {
+		t.Errorf("Expected the first occurrence of the ConfigMap to be kept but got %v", data)
+	}
+
+	_, _, err := runGenerator(
+		t, "--namespace", "my-policies", "--name", "my-policy", manifestPath, dir,
+	)
+	assertErrorContains(
+		t, err, "the object manifests contain the ConfigMap my-config object more than once",
+	)
+}
+
+func TestRunValidateCmd(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeTestFile(t, dir, "configmap.yaml", testConfigMap)
+	capturedPath := path.Join(dir, "captured.yaml")
+
+	stdout, _, err := runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--validate-cmd", "cat > "+capturedPath,
+		manifestPath,
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	captured, err := os.ReadFile(capturedPath)
+	if err != nil {
+		t.Fatalf("Failed to read the YAML passed to the validation command: %v", err)
+	}
+
+	if len(captured) == 0 || !strings.Contains(stdout, string(captured)) {
+		t.Errorf("Expected the validation command to get the generated YAML but got:\n%s", captured)
+	}
+
+	outputPath := path.Join(dir, "policy.yaml")
+	_, _, err = runGenerator(
+		t,
+		"--namespace", "my-policies",
+		"--name", "my-policy",
+		"--validate-cmd", "echo the policy is invalid >&2; exit 3",
+		"--output", outputPath,
+		manifestPath,
+	)
+	assertErrorContains(
+		t, err, "the validation command failed: exit status 3: the policy is invalid",
+	)
+
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("Expected no output to be written when the validation command fails")
+	}
+}
+
+func TestRunStandardAnnotations(t *testing.T) {
+	manifestPath := writeTestFile(t, t.TempDir(), "configmap.yaml", testConfigMap)
+
+	tests := []struct {
+		args     []string
+		expected map[string]interface{}
+	}{
+		{
+			[]string{manifestPath},
+			map[string]interface{}{
+				"policy.open-cluster-management.io/categories": "CM Configuration Management",
+				"policy.open-cluster-management.io/controls":   "CM-2 Baseline Configuration",
+				"policy.open-cluster-management.io/standards":  "NIST SP 800-53",
+			},
+		},
+		{[]string{"--standard-annotations=false", manifestPath}, nil},
+		{
+			// Explicitly provided annotations are still added
+			[]string{"--standard-annotations=false", "--standards", "CIS", manifestPath},
+			map[string]interface{}{"policy.open-cluster-management.io/standards": "CIS"},
+		},
+	}
+
+	for _, test := range tests {
+		policy := generateDocuments(t, test.args...)[0]
+		annotations, _ := getField(policy, "metadata", "annotations").(map[string]interface{})
+		if len(annotations) != len(test.expected) ||
+			(len(annotations) != 0 && !reflect.DeepEqual(annotations, test.expected)) {
+			t.Errorf(
+				"%v: expected the annotations %v but got %v", test.args, test.expected, annotations,
+			)
+		}
+	}
+}